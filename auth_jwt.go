@@ -0,0 +1,234 @@
+package mengine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/wxiaowar/mengine/json"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// JWT签名算法
+const (
+	JWTHS256 = "HS256"
+	JWTRS256 = "RS256"
+	JWTEdDSA = "EdDSA"
+)
+
+// JWTKey 校验密钥, Key的类型与Alg对应:
+// HS256 []byte, RS256 *rsa.PublicKey, EdDSA ed25519.PublicKey
+type JWTKey struct {
+	Kid string // 为空时匹配任意kid
+	Alg string
+	Key interface{}
+}
+
+type JWTOption struct {
+	Keys     []JWTKey
+	Audience string        // 不为空时要求aud包含该值
+	Leeway   time.Duration // exp/nbf允许的时钟误差
+	UidClaim string        // Uid所在的claim, 默认"sub"
+	Optional bool          // 未携带token时放行, Uid为0
+}
+
+// JWTAuth JWT认证中间件, token取自Authorization头或auth cookie,
+// 校验通过后填充ctx.Uid和ctx.Claims, 失败时按authfail返回
+func JWTAuth(opt *JWTOption) Middleware {
+	uidClaim := opt.UidClaim
+	if uidClaim == "" {
+		uidClaim = "sub"
+	}
+
+	return func(h HFunc) HFunc {
+		return func(ctx *Context, res map[string]interface{}) Error {
+			token := ctx.Token()
+			if token == "" {
+				if opt.Optional {
+					return h(ctx, res)
+				}
+				return AuthFailure("token not provided")
+			}
+
+			claims, e := opt.Verify(token, time.Now())
+			if e != nil {
+				return AuthFailure(fmt.Sprintf("invalid token %v", e))
+			}
+
+			uid, e := claimInt64(claims[uidClaim])
+			if e != nil {
+				return AuthFailure(fmt.Sprintf("invalid claim %v %v", uidClaim, e))
+			}
+
+			ctx.Uid = uid
+			ctx.Claims = claims
+			return h(ctx, res)
+		}
+	}
+}
+
+// Verify 校验签名和exp/nbf/aud, 返回claims
+func (opt *JWTOption) Verify(token string, now time.Time) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if e := decodeSegment(parts[0], &header); e != nil {
+		return nil, fmt.Errorf("header %v", e)
+	}
+
+	sig, e := base64.RawURLEncoding.DecodeString(parts[2])
+	if e != nil {
+		return nil, fmt.Errorf("signature %v", e)
+	}
+
+	if e = opt.verifySignature(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); e != nil {
+		return nil, e
+	}
+
+	claims := make(map[string]interface{})
+	if e = decodeSegment(parts[1], &claims); e != nil {
+		return nil, fmt.Errorf("claims %v", e)
+	}
+
+	if e = opt.verifyClaims(claims, now); e != nil {
+		return nil, e
+	}
+
+	return claims, nil
+}
+
+func (opt *JWTOption) verifySignature(alg, kid string, input, sig []byte) error {
+	for _, key := range opt.Keys {
+		if key.Alg != alg || (key.Kid != "" && kid != "" && key.Kid != kid) {
+			continue
+		}
+
+		ok := false
+		switch alg {
+		case JWTHS256:
+			if secret, b := key.Key.([]byte); b {
+				mac := hmac.New(sha256.New, secret)
+				mac.Write(input)
+				ok = hmac.Equal(mac.Sum(nil), sig)
+			}
+		case JWTRS256:
+			if pub, b := key.Key.(*rsa.PublicKey); b {
+				sum := sha256.Sum256(input)
+				ok = rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig) == nil
+			}
+		case JWTEdDSA:
+			if pub, b := key.Key.(ed25519.PublicKey); b {
+				ok = ed25519.Verify(pub, input, sig)
+			}
+		}
+
+		if ok {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("signature verify failed alg=%v kid=%v", alg, kid)
+}
+
+func (opt *JWTOption) verifyClaims(claims map[string]interface{}, now time.Time) error {
+	if v, ok := claims["exp"]; ok {
+		exp, e := claimTime(v)
+		if e != nil {
+			return fmt.Errorf("invalid exp %v", e)
+		}
+		if now.Add(-opt.Leeway).Unix() >= exp {
+			return errors.New("token expired")
+		}
+	}
+
+	if v, ok := claims["nbf"]; ok {
+		nbf, e := claimTime(v)
+		if e != nil {
+			return fmt.Errorf("invalid nbf %v", e)
+		}
+		if now.Add(opt.Leeway).Unix() < nbf {
+			return errors.New("token not valid yet")
+		}
+	}
+
+	if opt.Audience == "" {
+		return nil
+	}
+
+	switch aud := claims["aud"].(type) {
+	case string:
+		if aud == opt.Audience {
+			return nil
+		}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok && s == opt.Audience {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("audience mismatch, want %v", opt.Audience)
+}
+
+// decodeSegment base64url解码后按json解析, 数字保留为json.Number
+func decodeSegment(seg string, v interface{}) error {
+	bts, e := base64.RawURLEncoding.DecodeString(seg)
+	if e != nil {
+		return e
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
+
+// claimInt64 claim中的数字可能是json.Number或字符串
+func claimInt64(v interface{}) (int64, error) {
+	switch n := v.(type) {
+	case json.Number:
+		return n.Int64()
+	case string:
+		return strconv.ParseInt(n, 10, 64)
+	case nil:
+		return 0, errors.New("not provided")
+	default:
+		return 0, fmt.Errorf("unsupported type %T", v)
+	}
+}
+
+// claimTime exp/nbf为NumericDate, 可以有小数, 截断到秒
+func claimTime(v interface{}) (int64, error) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return claimInt64(v)
+	}
+
+	if i, e := n.Int64(); e == nil {
+		return i, nil
+	}
+
+	f, e := n.Float64()
+	if e != nil {
+		return 0, e
+	}
+	if math.IsNaN(f) || f >= math.MaxInt64 || f <= math.MinInt64 {
+		return 0, fmt.Errorf("out of range %v", n)
+	}
+
+	return int64(f), nil
+}
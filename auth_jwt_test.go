@@ -0,0 +1,126 @@
+package mengine
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signJWT 按header和claims的原始json生成token, sign为nil时签名为空
+func signJWT(header, claims string, sign func(input []byte) []byte) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	var sig []byte
+	if sign != nil {
+		sig = sign([]byte(input))
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerifySignature(t *testing.T) {
+	secret := []byte("secret")
+	hs256 := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+
+	rsaKey, e := rsa.GenerateKey(rand.Reader, 2048)
+	if e != nil {
+		t.Fatal(e)
+	}
+	rs256 := func(input []byte) []byte {
+		sum := sha256.Sum256(input)
+		sig, _ := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, sum[:])
+		return sig
+	}
+
+	edPub, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	eddsa := func(input []byte) []byte {
+		return ed25519.Sign(edKey, input)
+	}
+
+	opt := &JWTOption{Keys: []JWTKey{
+		{Kid: "h", Alg: JWTHS256, Key: secret},
+		{Kid: "r", Alg: JWTRS256, Key: &rsaKey.PublicKey},
+		{Alg: JWTEdDSA, Key: edPub},
+	}}
+
+	const claims = `{"sub":"1"}`
+	cases := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"hs256", signJWT(`{"alg":"HS256","kid":"h"}`, claims, hs256), true},
+		{"hs256 without kid", signJWT(`{"alg":"HS256"}`, claims, hs256), true},
+		{"rs256", signJWT(`{"alg":"RS256","kid":"r"}`, claims, rs256), true},
+		{"eddsa any kid", signJWT(`{"alg":"EdDSA","kid":"any"}`, claims, eddsa), true},
+		{"kid mismatch", signJWT(`{"alg":"HS256","kid":"r"}`, claims, hs256), false},
+		{"alg mismatch", signJWT(`{"alg":"RS256","kid":"r"}`, claims, hs256), false},
+		{"hs256 with rsa public key", signJWT(`{"alg":"HS256","kid":"r"}`, claims, func(input []byte) []byte {
+			mac := hmac.New(sha256.New, rsaKey.PublicKey.N.Bytes())
+			mac.Write(input)
+			return mac.Sum(nil)
+		}), false},
+		{"alg none", signJWT(`{"alg":"none"}`, claims, nil), false},
+		{"tampered claims", strings.Replace(signJWT(`{"alg":"HS256"}`, claims, hs256), ".eyJzdWIiOiIxIn0.", "."+base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"2"}`))+".", 1), false},
+		{"malformed", "a.b", false},
+	}
+
+	for _, c := range cases {
+		if _, e := opt.Verify(c.token, time.Now()); (e == nil) != c.ok {
+			t.Errorf("%v: Verify error = %v, want ok %v", c.name, e, c.ok)
+		}
+	}
+}
+
+func TestJWTVerifyClaims(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	secret := []byte("secret")
+	hs256 := func(input []byte) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write(input)
+		return mac.Sum(nil)
+	}
+
+	cases := []struct {
+		name     string
+		claims   string
+		leeway   time.Duration
+		audience string
+		ok       bool
+	}{
+		{"valid exp", `{"exp":1700000100}`, 0, "", true},
+		{"expired", `{"exp":1699999990}`, 0, "", false},
+		{"expired within leeway", `{"exp":1699999990}`, time.Minute, "", true},
+		{"fractional exp", `{"exp":1700000000.5}`, 0, "", false},
+		{"fractional exp valid", `{"exp":1700000001.5}`, 0, "", true},
+		{"exponent exp", `{"exp":1.8e9}`, 0, "", true},
+		{"exp not a number", `{"exp":"soon"}`, 0, "", false},
+		{"nbf in future", `{"nbf":1700000010}`, 0, "", false},
+		{"nbf within leeway", `{"nbf":1700000010}`, time.Minute, "", true},
+		{"fractional nbf", `{"nbf":1699999999.9}`, 0, "", true},
+		{"aud string", `{"aud":"api"}`, 0, "api", true},
+		{"aud array", `{"aud":["web","api"]}`, 0, "api", true},
+		{"aud mismatch", `{"aud":["web"]}`, 0, "api", false},
+		{"aud missing", `{}`, 0, "api", false},
+	}
+
+	for _, c := range cases {
+		opt := &JWTOption{
+			Keys:     []JWTKey{{Alg: JWTHS256, Key: secret}},
+			Leeway:   c.leeway,
+			Audience: c.audience,
+		}
+		if _, e := opt.Verify(signJWT(`{"alg":"HS256"}`, c.claims, hs256), now); (e == nil) != c.ok {
+			t.Errorf("%v: Verify error = %v, want ok %v", c.name, e, c.ok)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package mengine
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Grants 用户拥有的角色和权限, 权限"*"表示全部权限
+type Grants struct {
+	Roles []string
+	Perms []string
+}
+
+// Authorize 鉴权中间件, 按RouteConfig.Roles/Perms校验resolve加载的授权,
+// 需放在认证中间件之后; 拒绝(包括resolve失败)时返回CodeForbidden并记录审计日志
+func Authorize(resolve func(ctx *Context) (g *Grants, e error)) Middleware {
+	return func(h HFunc) HFunc {
+		return func(ctx *Context, res map[string]interface{}) Error {
+			rc := ctx.RouteConfig()
+			if len(rc.Roles) <= 0 && len(rc.Perms) <= 0 {
+				return h(ctx, res)
+			}
+
+			if ctx.Uid == 0 {
+				return AuthFailure("authorization requires login")
+			}
+
+			g, e := resolve(ctx)
+			if e != nil {
+				e = fmt.Errorf("resolve grants error %v", e)
+			} else {
+				e = g.check(rc)
+			}
+
+			if e != nil {
+				auditDeny(ctx, rc, e.Error())
+				return ForbiddenFailure(e.Error())
+			}
+
+			return h(ctx, res)
+		}
+	}
+}
+
+// auditDeny 记录拒绝的审计日志
+var auditDeny = func(ctx *Context, rc *RouteConfig, detail string) {
+	ctx.eg.Error().Str("status", "deny").
+		Int("code", CodeForbidden).
+		Str("uid", fmt.Sprint(ctx.Uid)).
+		Str("remote", ctx.IP()).
+		Str("uri", ctx.RequestURI()).
+		Str("roles", strings.Join(rc.Roles, ",")).
+		Str("perms", strings.Join(rc.Perms, ",")).
+		Str("detail", detail).Msg("authorize")
+}
+
+// HasRole 是否拥有任一角色
+func (g *Grants) HasRole(roles ...string) bool {
+	for _, role := range roles {
+		if contains(g.Roles, role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPerm 是否拥有全部权限
+func (g *Grants) HasPerm(perms ...string) bool {
+	if contains(g.Perms, "*") {
+		return true
+	}
+
+	for _, perm := range perms {
+		if !contains(g.Perms, perm) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (g *Grants) check(rc *RouteConfig) error {
+	if g == nil {
+		return fmt.Errorf("no grants")
+	}
+
+	if len(rc.Roles) > 0 && !g.HasRole(rc.Roles...) {
+		return fmt.Errorf("role required %v", rc.Roles)
+	}
+
+	if len(rc.Perms) > 0 && !g.HasPerm(rc.Perms...) {
+		return fmt.Errorf("permission required %v", rc.Perms)
+	}
+
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, v := range ss {
+		if v == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,74 @@
+package mengine
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAuthorize(t *testing.T) {
+	var audits []string
+	defer func(audit func(ctx *Context, rc *RouteConfig, detail string)) { auditDeny = audit }(auditDeny)
+	auditDeny = func(ctx *Context, rc *RouteConfig, detail string) {
+		audits = append(audits, ctx.Path()+" "+detail)
+	}
+
+	grants := map[int64]*Grants{
+		1: {Roles: []string{"admin"}, Perms: []string{"*"}},
+		2: {Roles: []string{"user"}, Perms: []string{"order.read"}},
+	}
+
+	mux := NewMux()
+	ok := func(c *Context, res map[string]interface{}) Error { return nil }
+	mux.Handle("/t/open", ok, nil)
+	mux.Handle("/t/admin", ok, &RouteConfig{Roles: []string{"admin", "ops"}})
+	mux.Handle("/t/orders", ok, &RouteConfig{Perms: []string{"order.read", "order.write"}})
+	mux.Handle("/t/read", ok, &RouteConfig{Perms: []string{"order.read"}})
+
+	eg := newTestEngine(mux)
+	eg.Use(func(h HFunc) HFunc { // 测试用认证: uid取自query
+		return func(c *Context, res map[string]interface{}) Error {
+			if n := c.GetParam("uid"); n != "" {
+				c.Uid = int64(n[0] - '0')
+			}
+			return h(c, res)
+		}
+	}, Authorize(func(c *Context) (*Grants, error) {
+		if c.Uid == 9 {
+			return nil, errors.New("store down")
+		}
+		return grants[c.Uid], nil
+	}))
+
+	cases := []struct {
+		path  string
+		code  string
+		audit string
+	}{
+		{"/t/open", `"code":0`, ""},
+		{"/t/admin", `"code":-2`, ""},
+		{"/t/admin?uid=1", `"code":0`, ""},
+		{"/t/admin?uid=2", `"code":-3`, "/t/admin role required [admin ops]"},
+		{"/t/orders?uid=1", `"code":0`, ""},
+		{"/t/orders?uid=2", `"code":-3`, "/t/orders permission required [order.read order.write]"},
+		{"/t/read?uid=2", `"code":0`, ""},
+		{"/t/read?uid=3", `"code":-3`, "/t/read no grants"},
+		{"/t/read?uid=9", `"code":-3`, "/t/read resolve grants error store down"},
+	}
+
+	for _, c := range cases {
+		audits = nil
+		w := serve(eg, c.path, "{}")
+		if !strings.Contains(w.Body.String(), c.code) {
+			t.Errorf("%v = %s, want %v", c.path, w.Body.String(), c.code)
+		}
+
+		want := []string(nil)
+		if c.audit != "" {
+			want = []string{c.audit}
+		}
+		if strings.Join(audits, "|") != strings.Join(want, "|") {
+			t.Errorf("%v audit = %q, want %q", c.path, audits, want)
+		}
+	}
+}
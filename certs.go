@@ -0,0 +1,195 @@
+package mengine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/wxiaowar/mlog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CertManager 证书管理, 通过tls.Config.GetCertificate提供证书,
+// 轮询证书文件的修改时间, 变化后重新加载, 支持按SNI选择多组证书
+type CertManager struct {
+	*mlog.MLog
+
+	mu    sync.RWMutex
+	pairs []*certPair
+	names map[string]*certPair // SNI name -> pair
+}
+
+type certPair struct {
+	certFile string
+	keyFile  string
+	modTime  time.Time
+	cert     *tls.Certificate
+}
+
+//
+func NewCertManager(log *mlog.MLog) *CertManager {
+	return &CertManager{
+		MLog:  log,
+		names: make(map[string]*certPair),
+	}
+}
+
+// Add 添加一组证书, 第一组为SNI不匹配时的默认证书
+func (cm *CertManager) Add(certFile, keyFile string) error {
+	pair := &certPair{certFile: certFile, keyFile: keyFile}
+	if e := pair.load(); e != nil {
+		return e
+	}
+
+	cm.mu.Lock()
+	cm.pairs = append(cm.pairs, pair)
+	cm.index()
+	cm.mu.Unlock()
+	return nil
+}
+
+// GetCertificate 用于tls.Config.GetCertificate
+func (cm *CertManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cm.mu.RLock()
+	defer cm.mu.RUnlock()
+
+	if len(cm.pairs) <= 0 {
+		return nil, errors.New("no certificate")
+	}
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if pair, ok := cm.names[name]; ok {
+		return pair.cert, nil
+	}
+
+	if i := strings.IndexByte(name, '.'); i > 0 { // 通配符证书
+		if pair, ok := cm.names["*"+name[i:]]; ok {
+			return pair.cert, nil
+		}
+	}
+
+	return cm.pairs[0].cert, nil
+}
+
+// Reload 重新加载文件有变化的证书, 加载失败时继续使用旧证书
+func (cm *CertManager) Reload() {
+	cm.mu.RLock()
+	pairs := append([]*certPair(nil), cm.pairs...)
+	cm.mu.RUnlock()
+
+	changed := false
+	for _, pair := range pairs {
+		modTime, e := pair.lastModified()
+		if e != nil {
+			cm.Error().Str("cert", pair.certFile).Str("detail", e.Error()).Msg("stat certificate fail")
+			continue
+		}
+
+		cm.mu.RLock()
+		loaded := pair.modTime // 与其他Reload并发时modTime可能正被更新
+		cm.mu.RUnlock()
+
+		if !modTime.After(loaded) {
+			continue
+		}
+
+		fresh := &certPair{certFile: pair.certFile, keyFile: pair.keyFile}
+		if e = fresh.load(); e != nil {
+			cm.Error().Str("cert", pair.certFile).Str("detail", e.Error()).Msg("reload certificate fail")
+			continue
+		}
+
+		cm.mu.Lock()
+		pair.cert, pair.modTime = fresh.cert, fresh.modTime // 文件名不变, 只替换证书
+		cm.mu.Unlock()
+
+		changed = true
+		cm.Info().Str("cert", pair.certFile).Str("expire", fresh.cert.Leaf.NotAfter.String()).Msg("reload certificate")
+	}
+
+	if changed {
+		cm.mu.Lock()
+		cm.index()
+		cm.mu.Unlock()
+	}
+}
+
+// Watch 每interval检查一次证书文件, 返回停止函数
+func (cm *CertManager) Watch(interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				cm.Reload()
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// index 重建SNI索引, 需持有写锁; 先添加的证书优先
+func (cm *CertManager) index() {
+	names := make(map[string]*certPair)
+	for _, pair := range cm.pairs {
+		leaf := pair.cert.Leaf
+		for _, name := range append([]string{leaf.Subject.CommonName}, leaf.DNSNames...) {
+			name = strings.ToLower(name)
+			if _, ok := names[name]; !ok && name != "" {
+				names[name] = pair
+			}
+		}
+	}
+
+	cm.names = names
+}
+
+func (pair *certPair) load() error {
+	modTime, e := pair.lastModified()
+	if e != nil {
+		return e
+	}
+
+	cert, e := tls.LoadX509KeyPair(pair.certFile, pair.keyFile)
+	if e != nil {
+		return e
+	}
+
+	if cert.Leaf == nil {
+		if cert.Leaf, e = x509.ParseCertificate(cert.Certificate[0]); e != nil {
+			return e
+		}
+	}
+
+	pair.cert = &cert
+	pair.modTime = modTime
+	return nil
+}
+
+// lastModified 证书和私钥中较新的修改时间
+func (pair *certPair) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{pair.certFile, pair.keyFile} {
+		fi, e := os.Stat(file)
+		if e != nil {
+			return latest, e
+		}
+
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+
+	return latest, nil
+}
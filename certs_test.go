@@ -0,0 +1,116 @@
+package mengine
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/wxiaowar/mlog"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// newTestCert 签发证书, parent为nil时自签名(CA)
+func newTestCert(t *testing.T, cn string, parent *testCert) *testCert {
+	key, e := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{cn},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if e != nil {
+		t.Fatal(e)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// write 写入dir, 返回证书和私钥文件
+func (tc *testCert) write(t *testing.T, dir, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if e := os.WriteFile(certFile, tc.certPEM, 0600); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.WriteFile(keyFile, tc.keyPEM, 0600); e != nil {
+		t.Fatal(e)
+	}
+	return certFile, keyFile
+}
+
+func (tc *testCert) tls() tls.Certificate {
+	pair, _ := tls.X509KeyPair(tc.certPEM, tc.keyPEM)
+	return pair
+}
+
+// RunTLS按文件创建的证书管理不写入调用方的opt
+func TestRunTLSKeepsOption(t *testing.T) {
+	certFile, keyFile := newTestCert(t, "localhost", nil).write(t, t.TempDir(), "server")
+
+	opt := &EngionOption{Addr: "127.0.0.1:0"}
+	eg := NewEngine(opt, &mlog.MLog{}, NewMux())
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- eg.RunTLS("", certFile, keyFile)
+	}()
+
+	for i := 0; i < 100; i++ {
+		eg.mu.Lock()
+		started := eg.certs != nil
+		eg.mu.Unlock()
+		if started {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	eg.ShutDown(time.Second)
+	<-errc
+
+	if opt.Certs != nil {
+		t.Error("RunTLS wrote the created CertManager into EngionOption")
+	}
+	if eg.certs == nil {
+		t.Error("RunTLS did not keep its CertManager")
+	}
+}
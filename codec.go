@@ -0,0 +1,170 @@
+package mengine
+
+import (
+	"bytes"
+	"errors"
+	"github.com/wxiaowar/mengine/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Codec 请求/响应body的编解码, 请求按Content-Type、响应按Accept选择, 默认json
+type Codec interface {
+	ContentType() string // 响应的Content-Type, 其媒体类型同时用于匹配请求
+	Marshal(res map[string]interface{}) ([]byte, error)
+	Unmarshal(bts []byte, body map[string]interface{}) error // 解析到body中, body不为nil
+}
+
+var (
+	codecs         = make(map[string]Codec) // media type -> codec
+	defCodec Codec = jsonCodec{}
+)
+
+func init() {
+	RegisterCodec(defCodec)
+	RegisterCodec(msgpackCodec{}, "application/x-msgpack")
+	RegisterCodec(protobufCodec{}, "application/protobuf")
+}
+
+// RegisterCodec 注册编解码, aliases为额外匹配的媒体类型, 需在Run之前调用; 同名覆盖
+func RegisterCodec(c Codec, aliases ...string) {
+	t := mediaType(c.ContentType())
+	if t == "application/json" { // 覆盖json时同时作为默认
+		defCodec = c
+	}
+
+	for _, t := range append([]string{t}, aliases...) {
+		codecs[strings.ToLower(t)] = c
+	}
+}
+
+func mediaType(contentType string) string {
+	t, _, e := mime.ParseMediaType(contentType)
+	if e != nil {
+		return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	}
+
+	return t
+}
+
+// requestCodec 按Content-Type选择, 未注册的类型按json处理以兼容旧客户端
+func requestCodec(r *http.Request) Codec {
+	if c, ok := codecs[mediaType(r.Header.Get("Content-Type"))]; ok {
+		return c
+	}
+
+	return defCodec
+}
+
+// responseCodec 选择Accept中q值最高的已注册类型, 没有明确匹配时与请求一致
+func responseCodec(r *http.Request) Codec {
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return requestCodec(r)
+	}
+
+	var (
+		best  Codec
+		bestQ float64
+	)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		c, ok := codecs[strings.ToLower(strings.TrimSpace(fields[0]))]
+		if !ok {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, e := strconv.ParseFloat(param[2:], 64); e == nil {
+					q = v
+				}
+			}
+		}
+
+		if q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+
+	if best == nil {
+		return requestCodec(r)
+	}
+
+	return best
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json;charset=utf-8"
+}
+
+func (jsonCodec) Marshal(res map[string]interface{}) ([]byte, error) {
+	return json.Marshal(res)
+}
+
+// Unmarshal 数字解析为json.Number, 避免超过2^53的整数(如uid)经过float64丢失精度
+func (jsonCodec) Unmarshal(bts []byte, body map[string]interface{}) error {
+	r := bytes.NewReader(bts)
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	if e := decoder.Decode(&body); e != nil {
+		return e
+	}
+
+	if !onlySpace(decoder.Buffered()) || !onlySpace(r) { // 与json.Unmarshal一致, 不允许多余的内容
+		return errors.New("invalid character after top-level value")
+	}
+
+	return nil
+}
+
+// onlySpace Buffered和bytes.Reader都是io.ByteReader, 逐字节检查避免复制剩余内容
+func onlySpace(r io.Reader) bool {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		bts, _ := ioutil.ReadAll(r)
+		return len(bytes.TrimSpace(bts)) <= 0
+	}
+
+	for {
+		c, e := br.ReadByte()
+		if e != nil {
+			return true
+		}
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return false
+		}
+	}
+}
+
+// plain 将处理函数放入res的任意值转为编码器支持的基础类型, 非基础类型先按json转换
+func plain(v interface{}) (interface{}, error) {
+	switch v.(type) {
+	case nil, bool, string, []byte, json.Number, float32, float64,
+		int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64,
+		map[string]interface{}, []interface{}:
+		return v, nil
+	}
+
+	bts, e := json.Marshal(v)
+	if e != nil {
+		return nil, e
+	}
+
+	var out interface{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber()
+	if e = decoder.Decode(&out); e != nil {
+		return nil, e
+	}
+
+	return out, nil
+}
@@ -0,0 +1,375 @@
+package mengine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wxiaowar/mengine/json"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// 嵌套超过该深度的body直接拒绝, 避免恶意请求耗尽栈
+const maxCodecDepth = 64
+
+var errCodecDepth = errors.New("nesting too deep")
+
+// msgpackCodec MessagePack, 整数解析为int64(超出时uint64), 浮点为float64, bin为[]byte
+type msgpackCodec struct{}
+
+func (msgpackCodec) ContentType() string {
+	return "application/msgpack"
+}
+
+func (msgpackCodec) Marshal(res map[string]interface{}) ([]byte, error) {
+	return msgpackAppend(make([]byte, 0, 256), res, 0)
+}
+
+func (msgpackCodec) Unmarshal(bts []byte, body map[string]interface{}) error {
+	d := &msgpackDecoder{bts: bts}
+	n, e := d.mapLen()
+	if e != nil {
+		return e
+	}
+
+	if e = d.mapInto(body, n, 0); e != nil {
+		return e
+	}
+
+	if d.off != len(bts) {
+		return errors.New("msgpack: trailing data")
+	}
+
+	return nil
+}
+
+func msgpackAppend(b []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+
+	v, e := plain(v)
+	if e != nil {
+		return nil, e
+	}
+
+	switch x := v.(type) {
+	case nil:
+		return append(b, 0xc0), nil
+	case bool:
+		if x {
+			return append(b, 0xc3), nil
+		}
+		return append(b, 0xc2), nil
+	case int:
+		return msgpackInt(b, int64(x)), nil
+	case int8:
+		return msgpackInt(b, int64(x)), nil
+	case int16:
+		return msgpackInt(b, int64(x)), nil
+	case int32:
+		return msgpackInt(b, int64(x)), nil
+	case int64:
+		return msgpackInt(b, x), nil
+	case uint:
+		return msgpackUint(b, uint64(x)), nil
+	case uint8:
+		return msgpackUint(b, uint64(x)), nil
+	case uint16:
+		return msgpackUint(b, uint64(x)), nil
+	case uint32:
+		return msgpackUint(b, uint64(x)), nil
+	case uint64:
+		return msgpackUint(b, x), nil
+	case float32:
+		return appendUint(append(b, 0xca), uint64(math.Float32bits(x)), 4), nil
+	case float64:
+		return appendUint(append(b, 0xcb), math.Float64bits(x), 8), nil
+	case json.Number:
+		if i, e := x.Int64(); e == nil {
+			return msgpackInt(b, i), nil
+		}
+		if u, e := strconv.ParseUint(string(x), 10, 64); e == nil {
+			return msgpackUint(b, u), nil
+		}
+		f, e := x.Float64()
+		if e != nil {
+			return nil, e
+		}
+		return msgpackAppend(b, f, depth)
+	case string:
+		b = msgpackHead(b, len(x), 0xa0, 32, 0xd9, 0xda, 0xdb)
+		return append(b, x...), nil
+	case []byte:
+		b = msgpackHead(b, len(x), 0, 0, 0xc4, 0xc5, 0xc6)
+		return append(b, x...), nil
+	case []interface{}:
+		b = msgpackHead(b, len(x), 0x90, 16, 0, 0xdc, 0xdd)
+		for _, item := range x {
+			if b, e = msgpackAppend(b, item, depth+1); e != nil {
+				return nil, e
+			}
+		}
+		return b, nil
+	case map[string]interface{}:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		b = msgpackHead(b, len(x), 0x80, 16, 0, 0xde, 0xdf)
+		for _, k := range keys {
+			b = msgpackHead(b, len(k), 0xa0, 32, 0xd9, 0xda, 0xdb)
+			b = append(b, k...)
+			if b, e = msgpackAppend(b, x[k], depth+1); e != nil {
+				return nil, e
+			}
+		}
+		return b, nil
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type %T", v)
+}
+
+// msgpackHead 写长度头, fix为0时没有fix格式, c8为0时没有8位长度格式
+func msgpackHead(b []byte, n int, fix byte, fixMax int, c8, c16, c32 byte) []byte {
+	switch {
+	case fix != 0 && n < fixMax:
+		return append(b, fix|byte(n))
+	case c8 != 0 && n <= math.MaxUint8:
+		return append(b, c8, byte(n))
+	case n <= math.MaxUint16:
+		return appendUint(append(b, c16), uint64(n), 2)
+	default:
+		return appendUint(append(b, c32), uint64(n), 4)
+	}
+}
+
+func msgpackInt(b []byte, i int64) []byte {
+	switch {
+	case i >= 0:
+		return msgpackUint(b, uint64(i))
+	case i >= -32:
+		return append(b, byte(i))
+	case i >= math.MinInt8:
+		return append(b, 0xd0, byte(i))
+	case i >= math.MinInt16:
+		return appendUint(append(b, 0xd1), uint64(i), 2)
+	case i >= math.MinInt32:
+		return appendUint(append(b, 0xd2), uint64(i), 4)
+	default:
+		return appendUint(append(b, 0xd3), uint64(i), 8)
+	}
+}
+
+func msgpackUint(b []byte, u uint64) []byte {
+	switch {
+	case u <= 0x7f:
+		return append(b, byte(u))
+	case u <= math.MaxUint8:
+		return append(b, 0xcc, byte(u))
+	case u <= math.MaxUint16:
+		return appendUint(append(b, 0xcd), u, 2)
+	case u <= math.MaxUint32:
+		return appendUint(append(b, 0xce), u, 4)
+	default:
+		return appendUint(append(b, 0xcf), u, 8)
+	}
+}
+
+// appendUint 大端写入n字节
+func appendUint(b []byte, u uint64, n int) []byte {
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, byte(u>>(8*uint(i))))
+	}
+
+	return b
+}
+
+type msgpackDecoder struct {
+	bts []byte
+	off int
+}
+
+var errMsgpackShort = errors.New("msgpack: unexpected end of data")
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if n < 0 || len(d.bts)-d.off < n {
+		return nil, errMsgpackShort
+	}
+
+	b := d.bts[d.off : d.off+n]
+	d.off += n
+	return b, nil
+}
+
+// size 读取n字节的大端长度, 长度不能超过剩余数据, 避免按伪造的长度分配内存
+func (d *msgpackDecoder) size(n int) (int, error) {
+	b, e := d.next(n)
+	if e != nil {
+		return 0, e
+	}
+
+	var l uint64
+	for _, c := range b {
+		l = l<<8 | uint64(c)
+	}
+
+	if l > uint64(len(d.bts)-d.off) {
+		return 0, errMsgpackShort
+	}
+
+	return int(l), nil
+}
+
+func (d *msgpackDecoder) mapLen() (int, error) {
+	b, e := d.next(1)
+	if e != nil {
+		return 0, e
+	}
+
+	switch c := b[0]; {
+	case c&0xf0 == 0x80:
+		return int(c & 0x0f), nil
+	case c == 0xde:
+		return d.size(2)
+	case c == 0xdf:
+		return d.size(4)
+	}
+
+	return 0, errors.New("msgpack: body is not a map")
+}
+
+func (d *msgpackDecoder) mapInto(m map[string]interface{}, n, depth int) error {
+	for i := 0; i < n; i++ {
+		k, e := d.value(depth + 1)
+		if e != nil {
+			return e
+		}
+
+		key, ok := k.(string)
+		if !ok {
+			return fmt.Errorf("msgpack: map key must be string, got %T", k)
+		}
+
+		if m[key], e = d.value(depth + 1); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+func (d *msgpackDecoder) value(depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+
+	b, e := d.next(1)
+	if e != nil {
+		return nil, e
+	}
+
+	c := b[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c&0x0f), depth)
+	case c&0xf0 == 0x80:
+		m := make(map[string]interface{}, c&0x0f)
+		return m, d.mapInto(m, int(c&0x0f), depth)
+	}
+
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, e := d.size(1 << (c - 0xc4))
+		if e != nil {
+			return nil, e
+		}
+		bin, e := d.next(n)
+		return append([]byte(nil), bin...), e
+	case 0xca:
+		u, e := d.uint(4)
+		return float64(math.Float32frombits(uint32(u))), e
+	case 0xcb:
+		u, e := d.uint(8)
+		return math.Float64frombits(u), e
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, e := d.uint(1 << (c - 0xcc))
+		if u > math.MaxInt64 {
+			return u, e
+		}
+		return int64(u), e
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (c - 0xd0)
+		u, e := d.uint(size)
+		shift := uint(64 - 8*size) // 符号扩展
+		return int64(u<<shift) >> shift, e
+	case 0xd9, 0xda, 0xdb:
+		n, e := d.size(1 << (c - 0xd9))
+		if e != nil {
+			return nil, e
+		}
+		return d.str(n)
+	case 0xdc, 0xdd:
+		n, e := d.size(2 << (c - 0xdc))
+		if e != nil {
+			return nil, e
+		}
+		return d.array(n, depth)
+	case 0xde, 0xdf:
+		n, e := d.size(2 << (c - 0xde))
+		if e != nil {
+			return nil, e
+		}
+		m := make(map[string]interface{}) // 嵌套时n都可能接近剩余长度, 不按n预先分配
+		return m, d.mapInto(m, n, depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported format 0x%x", c)
+}
+
+func (d *msgpackDecoder) uint(n int) (uint64, error) {
+	b, e := d.next(n)
+	if e != nil {
+		return 0, e
+	}
+
+	var u uint64
+	for _, c := range b {
+		u = u<<8 | uint64(c)
+	}
+
+	return u, nil
+}
+
+func (d *msgpackDecoder) str(n int) (string, error) {
+	b, e := d.next(n)
+	return string(b), e
+}
+
+// array 按实际读到的元素扩容, 不按声明的长度预先分配
+func (d *msgpackDecoder) array(n, depth int) ([]interface{}, error) {
+	arr := []interface{}{}
+	for i := 0; i < n; i++ {
+		v, e := d.value(depth + 1)
+		if e != nil {
+			return nil, e
+		}
+		arr = append(arr, v)
+	}
+
+	return arr, nil
+}
@@ -0,0 +1,368 @@
+package mengine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wxiaowar/mengine/json"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// protobufCodec body按google.protobuf.Struct编码, 客户端可直接用官方的struct.proto.
+// Struct中的数字都是double, 响应中绝对值超过2^53的整数编码为十进制字符串, 与json的数字文本一致
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return "application/x-protobuf"
+}
+
+func (protobufCodec) Marshal(res map[string]interface{}) ([]byte, error) {
+	return pbStruct(make([]byte, 0, 256), res, 0)
+}
+
+func (protobufCodec) Unmarshal(bts []byte, body map[string]interface{}) error {
+	return pbReadStruct(bts, body, 0)
+}
+
+// protobuf wire type
+const (
+	pbVarint  = 0
+	pbFixed64 = 1
+	pbBytes   = 2
+	pbFixed32 = 5
+)
+
+func pbAppendVarint(b []byte, u uint64) []byte {
+	for u >= 0x80 {
+		b = append(b, byte(u)|0x80)
+		u >>= 7
+	}
+
+	return append(b, byte(u))
+}
+
+func pbAppendTag(b []byte, field int, wire int) []byte {
+	return pbAppendVarint(b, uint64(field<<3|wire))
+}
+
+// pbAppendMessage 写入长度前缀的子消息
+func pbAppendMessage(b []byte, field int, msg func([]byte) ([]byte, error)) ([]byte, error) {
+	sub, e := msg(nil)
+	if e != nil {
+		return nil, e
+	}
+
+	b = pbAppendTag(b, field, pbBytes)
+	b = pbAppendVarint(b, uint64(len(sub)))
+	return append(b, sub...), nil
+}
+
+func pbAppendString(b []byte, field int, s string) []byte {
+	b = pbAppendTag(b, field, pbBytes)
+	b = pbAppendVarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// pbStruct Struct { map<string, Value> fields = 1; }
+func pbStruct(b []byte, m map[string]interface{}, depth int) ([]byte, error) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var e error
+	for _, k := range keys {
+		v := m[k]
+		b, e = pbAppendMessage(b, 1, func(entry []byte) ([]byte, error) {
+			entry = pbAppendString(entry, 1, k)
+			return pbAppendMessage(entry, 2, func(value []byte) ([]byte, error) {
+				return pbValue(value, v, depth+1)
+			})
+		})
+		if e != nil {
+			return nil, e
+		}
+	}
+
+	return b, nil
+}
+
+// pbValue Value { oneof kind { NullValue null_value = 1; double number_value = 2; string string_value = 3;
+// bool bool_value = 4; Struct struct_value = 5; ListValue list_value = 6; } }
+func pbValue(b []byte, v interface{}, depth int) ([]byte, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+
+	v, e := plain(v)
+	if e != nil {
+		return nil, e
+	}
+
+	var f float64
+	switch x := v.(type) {
+	case nil:
+		return append(pbAppendTag(b, 1, pbVarint), 0), nil
+	case bool:
+		b = pbAppendTag(b, 4, pbVarint)
+		if x {
+			return append(b, 1), nil
+		}
+		return append(b, 0), nil
+	case string:
+		return pbAppendString(b, 3, x), nil
+	case []byte: // 与json一致按base64字符串
+		s, e := json.Marshal(x)
+		if e != nil {
+			return nil, e
+		}
+		return pbAppendString(b, 3, string(s[1:len(s)-1])), nil
+	case map[string]interface{}:
+		return pbAppendMessage(b, 5, func(sub []byte) ([]byte, error) {
+			return pbStruct(sub, x, depth)
+		})
+	case []interface{}: // ListValue { repeated Value values = 1; }
+		return pbAppendMessage(b, 6, func(sub []byte) ([]byte, error) {
+			for _, item := range x {
+				var e error
+				sub, e = pbAppendMessage(sub, 1, func(value []byte) ([]byte, error) {
+					return pbValue(value, item, depth+1)
+				})
+				if e != nil {
+					return nil, e
+				}
+			}
+			return sub, nil
+		})
+	case json.Number:
+		if i, e := x.Int64(); e == nil {
+			return pbInt(b, i), nil
+		}
+		if u, e := strconv.ParseUint(string(x), 10, 64); e == nil {
+			return pbUint(b, u), nil
+		}
+		if f, e = x.Float64(); e != nil {
+			return nil, e
+		}
+	case float32:
+		f = float64(x)
+	case float64:
+		f = x
+	case int:
+		return pbInt(b, int64(x)), nil
+	case int8:
+		return pbInt(b, int64(x)), nil
+	case int16:
+		return pbInt(b, int64(x)), nil
+	case int32:
+		return pbInt(b, int64(x)), nil
+	case int64:
+		return pbInt(b, x), nil
+	case uint:
+		return pbUint(b, uint64(x)), nil
+	case uint8:
+		return pbUint(b, uint64(x)), nil
+	case uint16:
+		return pbUint(b, uint64(x)), nil
+	case uint32:
+		return pbUint(b, uint64(x)), nil
+	case uint64:
+		return pbUint(b, x), nil
+	default:
+		return nil, fmt.Errorf("protobuf: unsupported type %T", v)
+	}
+
+	return pbDouble(b, f), nil
+}
+
+// double能精确表示的整数范围
+const pbMaxExactInt = 1 << 53
+
+func pbDouble(b []byte, f float64) []byte {
+	return appendUintLE(pbAppendTag(b, 2, pbFixed64), math.Float64bits(f))
+}
+
+// pbInt 超出double精确范围的整数编码为字符串
+func pbInt(b []byte, i int64) []byte {
+	if i > pbMaxExactInt || i < -pbMaxExactInt {
+		return pbAppendString(b, 3, strconv.FormatInt(i, 10))
+	}
+
+	return pbDouble(b, float64(i))
+}
+
+func pbUint(b []byte, u uint64) []byte {
+	if u > pbMaxExactInt {
+		return pbAppendString(b, 3, strconv.FormatUint(u, 10))
+	}
+
+	return pbDouble(b, float64(u))
+}
+
+func appendUintLE(b []byte, u uint64) []byte {
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(u>>(8*uint(i))))
+	}
+
+	return b
+}
+
+var errPbShort = errors.New("protobuf: unexpected end of data")
+
+// pbField 读取一个字段, bytes类型返回内容, 数值类型返回val
+func pbField(bts []byte) (field, wire int, val uint64, data []byte, n int, e error) {
+	tag, l := pbVarintAt(bts)
+	if l <= 0 {
+		return 0, 0, 0, nil, 0, errPbShort
+	}
+	n = l
+	field, wire = int(tag>>3), int(tag&7)
+
+	switch wire {
+	case pbVarint:
+		if val, l = pbVarintAt(bts[n:]); l <= 0 {
+			return 0, 0, 0, nil, 0, errPbShort
+		}
+		n += l
+	case pbFixed64, pbFixed32:
+		size := 8
+		if wire == pbFixed32 {
+			size = 4
+		}
+		if len(bts)-n < size {
+			return 0, 0, 0, nil, 0, errPbShort
+		}
+		for i := size - 1; i >= 0; i-- {
+			val = val<<8 | uint64(bts[n+i])
+		}
+		n += size
+	case pbBytes:
+		size, l := pbVarintAt(bts[n:])
+		if l <= 0 || size > uint64(len(bts)-n-l) {
+			return 0, 0, 0, nil, 0, errPbShort
+		}
+		n += l
+		data = bts[n : n+int(size)]
+		n += int(size)
+	default:
+		return 0, 0, 0, nil, 0, fmt.Errorf("protobuf: unsupported wire type %v", wire)
+	}
+
+	return field, wire, val, data, n, nil
+}
+
+// pbVarintAt 返回值和占用的字节数, 数据不完整时字节数为0
+func pbVarintAt(bts []byte) (uint64, int) {
+	var u uint64
+	for i := 0; i < len(bts) && i < 10; i++ {
+		u |= uint64(bts[i]&0x7f) << (7 * uint(i))
+		if bts[i] < 0x80 {
+			return u, i + 1
+		}
+	}
+
+	return 0, 0
+}
+
+func pbReadStruct(bts []byte, m map[string]interface{}, depth int) error {
+	if depth > maxCodecDepth {
+		return errCodecDepth
+	}
+
+	for len(bts) > 0 {
+		field, wire, _, entry, n, e := pbField(bts)
+		if e != nil {
+			return e
+		}
+		bts = bts[n:]
+
+		if field != 1 || wire != pbBytes { // 忽略未知字段
+			continue
+		}
+
+		var (
+			key   string
+			value interface{}
+		)
+		for len(entry) > 0 {
+			field, wire, _, data, n, e := pbField(entry)
+			if e != nil {
+				return e
+			}
+			entry = entry[n:]
+
+			if wire != pbBytes {
+				continue
+			}
+
+			switch field {
+			case 1:
+				key = string(data)
+			case 2:
+				if value, e = pbReadValue(data, depth+1); e != nil {
+					return e
+				}
+			}
+		}
+
+		m[key] = value
+	}
+
+	return nil
+}
+
+func pbReadValue(bts []byte, depth int) (interface{}, error) {
+	if depth > maxCodecDepth {
+		return nil, errCodecDepth
+	}
+
+	var value interface{}
+	for len(bts) > 0 {
+		field, wire, val, data, n, e := pbField(bts)
+		if e != nil {
+			return nil, e
+		}
+		bts = bts[n:]
+
+		switch {
+		case field == 1 && wire == pbVarint:
+			value = nil
+		case field == 2 && wire == pbFixed64:
+			value = math.Float64frombits(val)
+		case field == 3 && wire == pbBytes:
+			value = string(data)
+		case field == 4 && wire == pbVarint:
+			value = val != 0
+		case field == 5 && wire == pbBytes:
+			m := make(map[string]interface{})
+			if e = pbReadStruct(data, m, depth); e != nil { // 与pbValue一致, Struct不单独计一层
+				return nil, e
+			}
+			value = m
+		case field == 6 && wire == pbBytes:
+			list := []interface{}{}
+			for len(data) > 0 {
+				field, wire, _, item, n, e := pbField(data)
+				if e != nil {
+					return nil, e
+				}
+				data = data[n:]
+
+				if field != 1 || wire != pbBytes {
+					continue
+				}
+
+				v, e := pbReadValue(item, depth+1)
+				if e != nil {
+					return nil, e
+				}
+				list = append(list, v)
+			}
+			value = list
+		}
+	}
+
+	return value, nil
+}
@@ -0,0 +1,151 @@
+package mengine
+
+import (
+	"github.com/wxiaowar/mengine/json"
+	"reflect"
+	"testing"
+)
+
+var codecInput = map[string]interface{}{
+	"nil":  nil,
+	"t":    true,
+	"s":    "中文",
+	"i":    -5,
+	"u":    uint64(1 << 63),
+	"big":  int64(1<<53 + 1),
+	"nbig": json.Number("18446744073709551615"),
+	"n":    json.Number("12"),
+	"f":    1.5,
+	"bin":  []byte("x"),
+	"list": []interface{}{1, "a", []interface{}{}},
+	"m":    map[string]interface{}{"k": "v", "e": map[string]interface{}{}},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	cases := []struct {
+		codec Codec
+		want  map[string]interface{}
+	}{
+		{msgpackCodec{}, map[string]interface{}{
+			"nil":  nil,
+			"t":    true,
+			"s":    "中文",
+			"i":    int64(-5),
+			"u":    uint64(1 << 63),
+			"big":  int64(1<<53 + 1),
+			"nbig": uint64(1<<64 - 1),
+			"n":    int64(12),
+			"f":    1.5,
+			"bin":  []byte("x"),
+			"list": []interface{}{int64(1), "a", []interface{}{}},
+			"m":    map[string]interface{}{"k": "v", "e": map[string]interface{}{}},
+		}},
+		{protobufCodec{}, map[string]interface{}{ // 超出double精确范围的整数为字符串
+			"nil":  nil,
+			"t":    true,
+			"s":    "中文",
+			"i":    float64(-5),
+			"u":    "9223372036854775808",
+			"big":  "9007199254740993",
+			"nbig": "18446744073709551615",
+			"n":    float64(12),
+			"f":    1.5,
+			"bin":  "eA==",
+			"list": []interface{}{float64(1), "a", []interface{}{}},
+			"m":    map[string]interface{}{"k": "v", "e": map[string]interface{}{}},
+		}},
+	}
+
+	for _, c := range cases {
+		bts, e := c.codec.Marshal(codecInput)
+		if e != nil {
+			t.Fatalf("%T Marshal error: %v", c.codec, e)
+		}
+
+		got := make(map[string]interface{})
+		if e = c.codec.Unmarshal(bts, got); e != nil {
+			t.Fatalf("%T Unmarshal error: %v", c.codec, e)
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%T round trip = %#v, want %#v", c.codec, got, c.want)
+		}
+	}
+}
+
+// nested n层嵌套的map
+func nested(n int) map[string]interface{} {
+	m := map[string]interface{}{}
+	for i := 1; i < n; i++ {
+		m = map[string]interface{}{"a": m}
+	}
+	return m
+}
+
+// 编码和解析的深度上限一致: 65层(根和64层子对象)可以往返, 再多一层都拒绝
+func TestCodecDepth(t *testing.T) {
+	for _, c := range []Codec{msgpackCodec{}, protobufCodec{}} {
+		bts, e := c.Marshal(nested(maxCodecDepth + 1))
+		if e != nil {
+			t.Fatalf("%T Marshal(%v levels) error: %v", c, maxCodecDepth+1, e)
+		}
+		if e = c.Unmarshal(bts, make(map[string]interface{})); e != nil {
+			t.Errorf("%T Unmarshal(%v levels) error: %v", c, maxCodecDepth+1, e)
+		}
+
+		if _, e = c.Marshal(nested(maxCodecDepth + 2)); e != errCodecDepth {
+			t.Errorf("%T Marshal(%v levels) = %v, want depth error", c, maxCodecDepth+2, e)
+		}
+	}
+
+	// 绕过编码的检查构造过深的输入
+	deep, _ := msgpackAppend(nil, nested(maxCodecDepth+2), -1)
+	if e := (msgpackCodec{}).Unmarshal(deep, make(map[string]interface{})); e != errCodecDepth {
+		t.Errorf("msgpack Unmarshal too deep = %v, want depth error", e)
+	}
+	deep, _ = pbStruct(nil, nested(maxCodecDepth+2), -1)
+	if e := (protobufCodec{}).Unmarshal(deep, make(map[string]interface{})); e != errCodecDepth {
+		t.Errorf("protobuf Unmarshal too deep = %v, want depth error", e)
+	}
+}
+
+func TestCodecMalformed(t *testing.T) {
+	for _, c := range []Codec{msgpackCodec{}, protobufCodec{}} {
+		bts, _ := c.Marshal(codecInput)
+		for i := 1; i < len(bts); i++ { // 截断不能panic
+			c.Unmarshal(bts[:i], make(map[string]interface{}))
+		}
+		if e := c.Unmarshal(bts[:len(bts)-1], make(map[string]interface{})); e == nil {
+			t.Errorf("%T Unmarshal truncated input should fail", c)
+		}
+	}
+
+	msgpack := [][]byte{
+		{},
+		{0xc1},                         // 未使用的格式
+		{0x91, 0x01},                   // 根不是map
+		{0x81, 0x01, 0x01},             // key不是字符串
+		{0x80, 0x00},                   // 多余的数据
+		{0xdf, 0xff, 0xff, 0xff, 0xff}, // 声明的长度超过数据
+		{0x81, 0xa1, 'a', 0xdd, 0xff, 0xff, 0xff, 0xff},
+		{0x81, 0xa1, 'a', 0xc6, 0x7f, 0xff, 0xff, 0xff},
+		{0x81, 0xa5, 'a'},
+	}
+	for i, bts := range msgpack {
+		if e := (msgpackCodec{}).Unmarshal(bts, make(map[string]interface{})); e == nil {
+			t.Errorf("msgpack malformed #%v % x should fail", i, bts)
+		}
+	}
+
+	protobuf := [][]byte{
+		{0x0b},                   // group, 不支持的wire type
+		{0x0a, 0x05, 0x0a},       // 长度超过数据
+		{0x0a, 0xff, 0xff, 0xff}, // 不完整的varint
+		{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // varint超过10字节
+		{0x0a, 0x04, 0x12, 0x02, 0x11, 0x00},                                      // double不足8字节
+	}
+	for i, bts := range protobuf {
+		if e := (protobufCodec{}).Unmarshal(bts, make(map[string]interface{})); e == nil {
+			t.Errorf("protobuf malformed #%v % x should fail", i, bts)
+		}
+	}
+}
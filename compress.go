@@ -0,0 +1,231 @@
+package mengine
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compressor 响应压缩算法, 名字即Content-Encoding的值
+type Compressor interface {
+	Name() string
+	Compress(dst io.Writer, src []byte) error
+}
+
+type CompressOption struct {
+	MinSize int      // 响应超过该字节数才压缩, 默认1024
+	Prefer  []string // 客户端q值相同时的优先顺序, 默认按注册顺序
+}
+
+var (
+	compressors   = make(map[string]Compressor)
+	compressOrder []string
+)
+
+func init() {
+	RegisterCompressor(&gzipCompressor{level: gzip.DefaultCompression})
+}
+
+// RegisterCompressor 注册压缩算法, 需在Run之前调用; 同名覆盖
+func RegisterCompressor(c Compressor) {
+	if _, ok := compressors[c.Name()]; !ok {
+		compressOrder = append(compressOrder, c.Name())
+	}
+	compressors[c.Name()] = c
+}
+
+// compress 按Accept-Encoding压缩响应, 返回实际使用的编码, 不压缩时为空
+func (eg *Engine) compress(ctx *Context, bts []byte) ([]byte, string) {
+	opt := eg.Compression
+	if opt == nil || ctx.RouteConfig().NoCompress {
+		return bts, ""
+	}
+
+	ctx.ResponseHeader().Add("Vary", "Accept-Encoding")
+
+	minSize := opt.MinSize
+	if minSize <= 0 {
+		minSize = 1024
+	}
+	if len(bts) < minSize {
+		return bts, ""
+	}
+
+	prefer := opt.Prefer
+	if len(prefer) <= 0 {
+		prefer = compressOrder
+	}
+
+	c := negotiate(ctx.Request.Header.Get("Accept-Encoding"), prefer)
+	if c == nil {
+		return bts, ""
+	}
+
+	buf := &bytes.Buffer{}
+	if e := c.Compress(buf, bts); e != nil {
+		eg.Error().Str("status", "fail").Str("encoding", c.Name()).Str("detail", e.Error()).Msg("compress fail")
+		return bts, ""
+	}
+
+	if buf.Len() >= len(bts) { // 压缩无收益
+		return bts, ""
+	}
+
+	return buf.Bytes(), c.Name()
+}
+
+// negotiate 选择q值最高的已注册算法, q值相同时按prefer的顺序
+func negotiate(accept string, prefer []string) Compressor {
+	if accept == "" {
+		return nil
+	}
+
+	qs := make(map[string]float64)
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, e := strconv.ParseFloat(param[2:], 64); e == nil {
+					q = v
+				}
+			}
+		}
+		qs[name] = q
+	}
+
+	var (
+		best  Compressor
+		bestQ float64
+	)
+	for _, name := range prefer {
+		c, ok := compressors[name]
+		if !ok {
+			continue
+		}
+
+		q, ok := qs[name]
+		if !ok {
+			q, ok = qs["*"]
+		}
+
+		if ok && q > bestQ {
+			best, bestQ = c, q
+		}
+	}
+
+	return best
+}
+
+type gzipCompressor struct {
+	level int
+	pool  sync.Pool
+}
+
+func (gc *gzipCompressor) Name() string {
+	return "gzip"
+}
+
+func (gc *gzipCompressor) Compress(dst io.Writer, src []byte) error {
+	zw, _ := gc.pool.Get().(*gzip.Writer)
+	if zw == nil {
+		var e error
+		if zw, e = gzip.NewWriterLevel(dst, gc.level); e != nil {
+			return e
+		}
+	} else {
+		zw.Reset(dst)
+	}
+	defer gc.pool.Put(zw)
+
+	if _, e := zw.Write(src); e != nil {
+		return e
+	}
+
+	return zw.Close()
+}
+
+// 请求解压后的默认大小上限
+const defaultMaxBodySize = 32 << 20
+
+var errBodyTooLarge = errors.New("body too large")
+
+// inflate 按Content-Encoding将请求body解压到buf
+func (eg *Engine) inflate(buf *bytes.Buffer, r io.Reader, encoding string) error {
+	zr, e := eg.inflateReader(r, encoding)
+	if e != nil {
+		return e
+	}
+
+	_, e = buf.ReadFrom(zr)
+	return e
+}
+
+// inflateReader 按Content-Encoding解压的reader, 解压后超过MaxBodySize时读取返回错误, 防止压缩炸弹
+func (eg *Engine) inflateReader(r io.Reader, encoding string) (io.Reader, error) {
+	var zr io.Reader
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return r, nil
+
+	case "gzip", "x-gzip":
+		gr, e := gzip.NewReader(r)
+		if e != nil {
+			return nil, e
+		}
+		zr = gr
+
+	case "deflate": // 按RFC为zlib格式, 兼容部分客户端发送的裸deflate
+		br := bufio.NewReader(r)
+		if header, e := br.Peek(2); e == nil && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			fr, e := zlib.NewReader(br)
+			if e != nil {
+				return nil, e
+			}
+			zr = fr
+		} else {
+			zr = flate.NewReader(br)
+		}
+
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %v", encoding)
+	}
+
+	limit := eg.MaxBodySize
+	if limit <= 0 {
+		limit = defaultMaxBodySize
+	}
+
+	return &limitedReader{r: zr, n: limit}, nil
+}
+
+// limitedReader 与io.LimitReader不同, 超出限制时返回错误而不是EOF
+type limitedReader struct {
+	r io.Reader
+	n int64 // 剩余可读的字节数
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+
+	n, e := l.r.Read(p)
+	if int64(n) > l.n {
+		n, l.n = int(l.n), 0
+		return n, errBodyTooLarge
+	}
+
+	l.n -= int64(n)
+	return n, e
+}
@@ -0,0 +1,36 @@
+// +build brotli
+
+package mengine
+
+import (
+	"github.com/andybalholm/brotli"
+	"io"
+)
+
+// 使用 -tags=brotli 编译时支持br, 客户端同时接受时优先于gzip
+func init() {
+	RegisterCompressor(brotliCompressor{})
+
+	order := []string{"br"} // 移到最前, 保留其他已注册的算法
+	for _, name := range compressOrder {
+		if name != "br" {
+			order = append(order, name)
+		}
+	}
+	compressOrder = order
+}
+
+type brotliCompressor struct{}
+
+func (brotliCompressor) Name() string {
+	return "br"
+}
+
+func (brotliCompressor) Compress(dst io.Writer, src []byte) error {
+	bw := brotli.NewWriterLevel(dst, brotli.DefaultCompression)
+	if _, e := bw.Write(src); e != nil {
+		return e
+	}
+
+	return bw.Close()
+}
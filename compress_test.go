@@ -0,0 +1,197 @@
+package mengine
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type fakeCompressor string
+
+func (fc fakeCompressor) Name() string {
+	return string(fc)
+}
+
+func (fc fakeCompressor) Compress(dst io.Writer, src []byte) error {
+	_, e := dst.Write(src[:1])
+	return e
+}
+
+// registerBr 没有brotli构建标签时注册一个假的br, 测试结束后恢复
+func registerBr(t *testing.T) {
+	if _, ok := compressors["br"]; ok {
+		return
+	}
+
+	order := compressOrder
+	RegisterCompressor(fakeCompressor("br"))
+	t.Cleanup(func() {
+		delete(compressors, "br")
+		compressOrder = order
+	})
+}
+
+func TestNegotiate(t *testing.T) {
+	registerBr(t)
+
+	cases := []struct {
+		accept string
+		prefer []string
+		want   string
+	}{
+		{"", []string{"br", "gzip"}, ""},
+		{"gzip", []string{"br", "gzip"}, "gzip"},
+		{"gzip, br", []string{"br", "gzip"}, "br"},
+		{"br, gzip", []string{"gzip", "br"}, "gzip"},
+		{"br;q=0.5, gzip", []string{"br", "gzip"}, "gzip"},
+		{"br;q=0, gzip;q=0.1", []string{"br", "gzip"}, "gzip"},
+		{"gzip;q=0", []string{"br", "gzip"}, ""},
+		{"gzip;q=0, br;q=0", []string{"br", "gzip"}, ""},
+		{"*", []string{"br", "gzip"}, "br"},
+		{"*;q=0.5, br;q=0", []string{"br", "gzip"}, "gzip"},
+		{"identity, deflate", []string{"br", "gzip"}, ""},
+		{" GZip ; q=0.8 ", []string{"br", "gzip"}, "gzip"},
+		{"zstd, gzip;q=0.1", []string{"zstd", "gzip"}, "gzip"}, // 未注册的算法
+	}
+
+	for _, c := range cases {
+		got := ""
+		if comp := negotiate(c.accept, c.prefer); comp != nil {
+			got = comp.Name()
+		}
+		if got != c.want {
+			t.Errorf("negotiate(%q, %v) = %q, want %q", c.accept, c.prefer, got, c.want)
+		}
+	}
+}
+
+func TestInflate(t *testing.T) {
+	plain := []byte(strings.Repeat(`{"k":"v"}`, 100))
+
+	var gz, zl, raw bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(plain)
+	gw.Close()
+	zw := zlib.NewWriter(&zl)
+	zw.Write(plain)
+	zw.Close()
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	fw.Write(plain)
+	fw.Close()
+
+	eg := newTestEngine(NewMux())
+	cases := []struct {
+		encoding string
+		body     []byte
+	}{
+		{"", plain},
+		{"identity", plain},
+		{"gzip", gz.Bytes()},
+		{"X-GZIP", gz.Bytes()},
+		{"deflate", zl.Bytes()},  // RFC的zlib格式
+		{"deflate", raw.Bytes()}, // 裸deflate
+	}
+	for _, c := range cases {
+		buf := &bytes.Buffer{}
+		if e := eg.inflate(buf, bytes.NewReader(c.body), c.encoding); e != nil || !bytes.Equal(buf.Bytes(), plain) {
+			t.Errorf("inflate(%q) = %d bytes, %v", c.encoding, buf.Len(), e)
+		}
+	}
+
+	if e := eg.inflate(&bytes.Buffer{}, bytes.NewReader(plain), "compress"); e == nil {
+		t.Error("inflate(compress) should fail")
+	}
+}
+
+// 解压后超过MaxBodySize即停止, 恰好等于上限时通过
+func TestInflateBomb(t *testing.T) {
+	var gz bytes.Buffer
+	gw := gzip.NewWriter(&gz)
+	gw.Write(make([]byte, 64<<20))
+	gw.Close()
+
+	eg := newTestEngine(NewMux())
+	eg.MaxBodySize = 1 << 20
+
+	buf := &bytes.Buffer{}
+	if e := eg.inflate(buf, bytes.NewReader(gz.Bytes()), "gzip"); e != errBodyTooLarge || buf.Len() > 1<<20 {
+		t.Fatalf("bomb = %d bytes, %v, want body too large", buf.Len(), e)
+	}
+
+	gz.Reset()
+	gw = gzip.NewWriter(&gz)
+	gw.Write(make([]byte, 1<<20))
+	gw.Close()
+	buf.Reset()
+	if e := eg.inflate(buf, bytes.NewReader(gz.Bytes()), "gzip"); e != nil || buf.Len() != 1<<20 {
+		t.Fatalf("at limit = %d bytes, %v", buf.Len(), e)
+	}
+
+	mux := NewMux()
+	mux.Handle("/t/upload", func(c *Context, res map[string]interface{}) Error { return nil }, nil)
+	eg = newTestEngine(mux)
+	eg.MaxBodySize = 1024
+
+	gz.Reset()
+	gw = gzip.NewWriter(&gz)
+	gw.Write([]byte(`{"pad":"` + strings.Repeat("x", 4096) + `"}`))
+	gw.Close()
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "/t/upload", bytes.NewReader(gz.Bytes()))
+	r.Header.Set("Content-Encoding", "gzip")
+	eg.ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"code":-1`) {
+		t.Fatalf("oversized upload = %s, want readbody failure", w.Body.String())
+	}
+}
+
+// x通道先压缩再加密, 编码通过X-Content-Encoding告知, 不设置Content-Encoding
+func TestCompressEncrypted(t *testing.T) {
+	mux := NewMux()
+	handler := func(c *Context, res map[string]interface{}) Error {
+		res["data"] = strings.Repeat("payload ", 64)
+		return nil
+	}
+	mux.Handle("/x/data", handler, nil)
+	mux.Handle("/t/data", handler, nil)
+
+	eg := newTestEngine(mux)
+	eg.Compression = &CompressOption{MinSize: 16}
+	eg.encrypt = func(ctx *Context, bts []byte) ([]byte, error) {
+		return append([]byte("ENC:"), bts...), nil
+	}
+
+	request := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader("{}"))
+		r.Header.Set("Accept-Encoding", "gzip")
+		eg.ServeHTTP(w, r)
+		return w
+	}
+
+	w := request("/x/data")
+	body := w.Body.Bytes()
+	if !bytes.HasPrefix(body, []byte("ENC:\x1f\x8b")) || w.Header().Get("X-Content-Encoding") != "gzip" || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("encrypted = %q %v, want encrypted gzip", body[:8], w.Header())
+	}
+
+	zr, e := gzip.NewReader(bytes.NewReader(body[4:]))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if plain, _ := io.ReadAll(zr); !strings.Contains(string(plain), "payload payload") {
+		t.Fatalf("decrypted = %s", plain)
+	}
+
+	w = request("/t/data")
+	if w.Header().Get("Content-Encoding") != "gzip" || w.Header().Get("X-Content-Encoding") != "" || w.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("trusted = %v, want Content-Encoding gzip", w.Header())
+	}
+}
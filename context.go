@@ -7,43 +7,106 @@ import (
 	"io/ioutil"
 	"github.com/wxiaowar/mengine/json"
 	"github.com/wxiaowar/mpkg/convert"
+	"net"
 	"net/http"
 	"os"
 	"reflect"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type Context struct {
+	// Body和BodyRaw只在处理函数返回前有效: BodyRaw指向池化的缓冲, 返回后会被其他请求覆盖;
+	// 需要在goroutine中或返回后使用时先Copy, 或自行复制
 	Body    map[string]interface{}
 	BodyRaw []byte
 
 	Request *http.Request
 	Uid     int64
+	Claims  map[string]interface{} // 认证通过后的JWT claims
+
+	eg      *Engine
+	writer  http.ResponseWriter
+	route   *RouteConfig
+	start   time.Time
+	keys    keys
+	codec   Codec // 请求body的编解码, 按Content-Type选择
+	body    uint8 // body的读取状态, 见stream.go
+	bodyErr error // EnsureBody中延迟解析body的错误, 处理函数返回后以comfail返回
+
+	buf      *bytes.Buffer // 池化的body缓冲
+	released int32         // 处理函数已返回, 见guard
+	detached bool          // 处理函数超时仍在运行, 不能回收
+	streamed int32         // 响应已由SSE/WebSocket接管, handle不再写结果
+}
+
+// RouteConfig 当前路由的配置, 不会返回nil
+func (ctx *Context) RouteConfig() *RouteConfig {
+	if ctx.route == nil {
+		return emptyRouteConfig
+	}
+	return ctx.route
 }
 
 func (ctx *Context) GetParam(name string) string {
+	ctx.guard()
 	return ctx.Request.URL.Query().Get(name)
 }
 
+// IP 客户端IP, 见ClientIP; 无法确定时返回"", 调用方应视为未知, 不能用对端地址代替
 func (ctx *Context) IP() string {
-	ips := strings.Split(ctx.Request.Header.Get("X-Forwarded-For"), ",")
-	if len(ips[0]) > 3 {
-		return ips[0]
-	} else {
-		addr := strings.Split(ctx.Request.RemoteAddr, ":")
-		return addr[0]
+	ctx.guard()
+	if ip := ctx.ClientIP(); ip != nil {
+		return ip.String()
 	}
+
+	return ""
+}
+
+// ClientIP 客户端IP, 只有对端是EngionOption.TrustedProxies中的代理时才读取转发头
+func (ctx *Context) ClientIP() net.IP {
+	if ctx.eg == nil {
+		return remoteIP(ctx.Request.RemoteAddr)
+	}
+
+	return ctx.eg.clientIP(ctx.Request)
+}
+
+// remoteIP 解析RemoteAddr, 兼容IPv6的"[::1]:port"格式
+func remoteIP(addr string) net.IP {
+	host, _, e := net.SplitHostPort(addr)
+	if e != nil {
+		host = addr
+	}
+
+	return net.ParseIP(strings.Trim(host, "[]"))
 }
 
 func (ctx *Context) RemoteAddr() string {
+	ctx.guard()
 	return ctx.Request.RemoteAddr
 }
 
 func (ctx *Context) Cookie(name string) (*http.Cookie, error) {
+	ctx.guard()
 	return ctx.Request.Cookie(name)
 }
 
+// ResponseHeader 响应头, 需在处理函数返回前设置
+func (ctx *Context) ResponseHeader() http.Header {
+	ctx.guard()
+	return ctx.writer.Header()
+}
+
+// SetCookie 在响应中设置cookie
+func (ctx *Context) SetCookie(c *http.Cookie) {
+	ctx.guard()
+	http.SetCookie(ctx.writer, c)
+}
+
 func (ctx *Context) GetAuth() string {
+	ctx.guard()
 	c, e := ctx.Request.Cookie("auth")
 	if e != nil {
 		return "auth=''"
@@ -52,24 +115,48 @@ func (ctx *Context) GetAuth() string {
 	return c.Value
 }
 
+// Token 请求携带的凭证, 优先取"Authorization: Bearer", 其次取auth cookie
+func (ctx *Context) Token() string {
+	ctx.guard()
+	if h := ctx.Request.Header.Get("Authorization"); len(h) > 7 && strings.EqualFold(h[:7], "Bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+
+	if c, e := ctx.Request.Cookie("auth"); e == nil {
+		return c.Value
+	}
+
+	return ""
+}
+
 func (ctx *Context) Path() string {
+	ctx.guard()
 	return ctx.Request.URL.Path
 }
 
 func (ctx *Context) RequestURI() string {
+	ctx.guard()
 	return ctx.Request.RequestURI
 }
 
 func (ctx *Context) Host() string {
+	ctx.guard()
 	return ctx.Request.Host
 }
 
 func (ctx *Context) Header() http.Header {
+	ctx.guard()
 	return ctx.Request.Header
 }
 
-//检查Body中的字段是否齐全
+//检查Body中的字段是否齐全; Stream路由的body解析失败时返回false, 请求以readbody error失败, 不使用处理结果
 func (ctx *Context) EnsureBody(keys ...string) (string, bool) {
+	ctx.guard()
+	if e := ctx.materialize(); e != nil {
+		ctx.bodyErr = e
+		return "", false
+	}
+
 	for _, key := range keys {
 		if _, ok := ctx.Body[key]; !ok {
 			return key, false
@@ -78,116 +165,144 @@ func (ctx *Context) EnsureBody(keys ...string) (string, bool) {
 	return "", true
 }
 
-// 兼容 科学计数法float64类型
+// 兼容 科学计数法float64类型; body不是json时按解析后的Body转换
 func (ctx *Context) DecodeJson(v interface{}) error {
-	decoder := json.NewDecoder(bytes.NewReader(ctx.BodyRaw))
+	ctx.guard()
+	if ctx.body != bodyParsed { // Stream路由直接从流中解码, 不生成Body
+		decoder, e := ctx.Decoder()
+		if e == nil {
+			return decoder.Decode(v)
+		}
+		if e != errBodyNotJson {
+			return e
+		}
+
+		if e = ctx.materialize(); e != nil {
+			return e
+		}
+	}
+
+	bts := ctx.BodyRaw
+	if _, ok := ctx.bodyCodec().(jsonCodec); !ok {
+		var e error
+		if bts, e = json.Marshal(ctx.Body); e != nil {
+			return e
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(bts))
 	decoder.UseNumber()
 	return decoder.Decode(v)
 }
 
 //带默认值的解析
 func (ctx *Context) ParseOpt(params ...interface{}) error {
+	ctx.guard()
 	if len(params)%3 != 0 {
 		return errors.New("params count invalid")
 	}
+	if e := ctx.materialize(); e != nil {
+		return e
+	}
 	for i := 0; i < len(params); i += 3 {
 		key := convert.ToString(params[i])
 		v, ok := ctx.Body[key]
+		n := number(v)
 		var e error
 		switch ref := params[i+1].(type) {
 		case *string:
 			if ok {
-				*ref = convert.ToString(v)
+				*ref = toString(v)
 			} else {
 				*ref = convert.ToString(params[i+2])
 			}
 		case *float64:
 			if ok {
-				*ref, e = convert.ToFloat64(v)
+				*ref, e = convert.ToFloat64(n)
 			} else {
 				*ref, e = convert.ToFloat64(params[i+2])
 			}
 		case *int:
 			if ok {
-				*ref, e = convert.ToInt(v)
+				*ref, e = convert.ToInt(n)
 			} else {
 				*ref, e = convert.ToInt(params[i+2])
 			}
 		case *int8:
 			if ok {
-				*ref, e = convert.ToInt8(v)
+				*ref, e = convert.ToInt8(n)
 			} else {
 				*ref, e = convert.ToInt8(params[i+2])
 			}
 		case *int16:
 			if ok {
-				*ref, e = convert.ToInt16(v)
+				*ref, e = convert.ToInt16(n)
 			} else {
 				*ref, e = convert.ToInt16(params[i+2])
 			}
 		case *int32:
 			if ok {
-				*ref, e = convert.ToInt32(v)
+				*ref, e = convert.ToInt32(n)
 			} else {
 				*ref, e = convert.ToInt32(params[i+2])
 			}
 		case *int64:
 			if ok {
-				*ref, e = convert.ToInt64(v)
+				*ref, e = convert.ToInt64(n)
 			} else {
 				*ref, e = convert.ToInt64(params[i+2])
 			}
 		case *uint:
 			if ok {
-				*ref, e = convert.ToUint(v)
+				*ref, e = convert.ToUint(n)
 			} else {
 				*ref, e = convert.ToUint(params[i+2])
 			}
 		case *uint8:
 			if ok {
-				*ref, e = convert.ToUint8(v)
+				*ref, e = convert.ToUint8(n)
 			} else {
 				*ref, e = convert.ToUint8(params[i+2])
 			}
 		case *uint16:
 			if ok {
-				*ref, e = convert.ToUint16(v)
+				*ref, e = convert.ToUint16(n)
 			} else {
 				*ref, e = convert.ToUint16(params[i+2])
 			}
 		case *uint32:
 			if ok {
-				*ref, e = convert.ToUint32(v)
+				*ref, e = convert.ToUint32(n)
 			} else {
 				*ref, e = convert.ToUint32(params[i+2])
 			}
 		case *uint64:
 			if ok {
-				*ref, e = convert.ToUint64(v)
+				*ref, e = convert.ToUint64(n)
 			} else {
 				*ref, e = convert.ToUint64(params[i+2])
 			}
 		case *bool:
 			if ok {
-				*ref, e = convert.ToBool(v)
+				*ref, e = convert.ToBool(n)
 			} else {
 				*ref, e = convert.ToBool(params[i+2])
 			}
 		case *[]string:
 			if ok {
-				*ref, e = convert.ToStringSlice(v)
+				*ref, e = convert.ToStringSlice(n)
 			} else {
 				*ref = params[i+2].([]string)
 			}
 		case *[]int64:
 			if ok {
-				*ref, e = convert.ToInt64Slice(v)
+				*ref, e = convert.ToInt64Slice(n)
 			} else {
 				*ref = params[i+2].([]int64)
 			}
 		case *[]uint32:
 			if ok {
-				*ref, e = convert.ToUint32Slice(v)
+				*ref, e = convert.ToUint32Slice(n)
 			} else {
 				*ref = params[i+2].([]uint32)
 			}
@@ -231,46 +346,51 @@ func (ctx *Context) ParseOpt(params ...interface{}) error {
 
 //不带默认值的解析
 func (ctx *Context) Parse(params ...interface{}) error {
+	ctx.guard()
 	if len(params)%2 != 0 {
 		return errors.New("params count must be even")
 	}
+	if e := ctx.materialize(); e != nil {
+		return e
+	}
 	for i := 0; i < len(params); i += 2 {
 		key := convert.ToString(params[i])
 		if v, ok := ctx.Body[key]; ok {
+			n := number(v)
 			var e error
 			switch ref := params[i+1].(type) {
 			case *string:
-				*ref = convert.ToString(v)
+				*ref = toString(v)
 			case *float64:
-				*ref, e = convert.ToFloat64(v)
+				*ref, e = convert.ToFloat64(n)
 			case *int:
-				*ref, e = convert.ToInt(v)
+				*ref, e = convert.ToInt(n)
 			case *int8:
-				*ref, e = convert.ToInt8(v)
+				*ref, e = convert.ToInt8(n)
 			case *int16:
-				*ref, e = convert.ToInt16(v)
+				*ref, e = convert.ToInt16(n)
 			case *int32:
-				*ref, e = convert.ToInt32(v)
+				*ref, e = convert.ToInt32(n)
 			case *int64:
-				*ref, e = convert.ToInt64(v)
+				*ref, e = convert.ToInt64(n)
 			case *uint:
-				*ref, e = convert.ToUint(v)
+				*ref, e = convert.ToUint(n)
 			case *uint8:
-				*ref, e = convert.ToUint8(v)
+				*ref, e = convert.ToUint8(n)
 			case *uint16:
-				*ref, e = convert.ToUint16(v)
+				*ref, e = convert.ToUint16(n)
 			case *uint32:
-				*ref, e = convert.ToUint32(v)
+				*ref, e = convert.ToUint32(n)
 			case *uint64:
-				*ref, e = convert.ToUint64(v)
+				*ref, e = convert.ToUint64(n)
 			case *bool:
-				*ref, e = convert.ToBool(v)
+				*ref, e = convert.ToBool(n)
 			case *[]string:
-				*ref, e = convert.ToStringSlice(v)
+				*ref, e = convert.ToStringSlice(n)
 			case *[]int64:
-				*ref, e = convert.ToInt64Slice(v)
+				*ref, e = convert.ToInt64Slice(n)
 			case *[]uint32:
-				*ref, e = convert.ToUint32Slice(v)
+				*ref, e = convert.ToUint32Slice(n)
 			case *map[string]interface{}:
 				switch m := v.(type) {
 				case map[string]interface{}:
@@ -300,7 +420,43 @@ func (ctx *Context) Parse(params ...interface{}) error {
 	return nil
 }
 
+// toString json.Number原样返回, 如"1.50"、"1e3"不经过数字转换
+func toString(v interface{}) string {
+	if x, ok := v.(json.Number); ok {
+		return string(x)
+	}
+
+	return convert.ToString(v)
+}
+
+// number 将json.Number转为int64/uint64/float64再交给convert, 整数不经过float64, 大整数(如uid)不丢精度
+func number(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, e := x.Int64(); e == nil {
+			return i
+		}
+		if u, e := strconv.ParseUint(string(x), 10, 64); e == nil {
+			return u
+		}
+		if f, e := x.Float64(); e == nil {
+			return f
+		}
+		return string(x)
+
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, item := range x {
+			out[i] = number(item)
+		}
+		return out
+	}
+
+	return v
+}
+
 func (ctx *Context) PostFile(param string, filename string) (e error) {
+	ctx.guard()
 	// hr.request.ParseMultipartForm(1024 * 1024 * 10)
 	file, _, e := ctx.Request.FormFile(param)
 	if e != nil {
@@ -319,6 +475,7 @@ func (ctx *Context) PostFile(param string, filename string) (e error) {
 
 //获取HTTP post的详细信息
 func (ctx *Context) PostFileInfo(param string) (bytes []byte, filename string, e error) {
+	ctx.guard()
 	// hr.request.ParseMultipartForm(1024 * 1024 * 10)
 	file, handler, e := ctx.Request.FormFile(param)
 	if e != nil {
@@ -338,6 +495,7 @@ func (ctx *Context) PostFileInfo(param string) (bytes []byte, filename string, e
 
 //参照prase 写的getparams。
 func (ctx *Context) GetParams(params ...interface{}) error {
+	ctx.guard()
 	if len(params)%2 != 0 {
 		return errors.New("params count must be odd")
 	}
@@ -396,6 +554,7 @@ func (ctx *Context) GetParams(params ...interface{}) error {
 }
 
 func (ctx *Context) GetParamOpt(params ...interface{}) error {
+	ctx.guard()
 	if len(params)%3 != 0 {
 		return errors.New("params count invalid")
 	}
@@ -0,0 +1,77 @@
+package mengine
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// 超过2^53的uid经过Parse/ParseOpt/DecodeJson不能丢失精度, t/i/x通道一致
+func TestLargeUid(t *testing.T) {
+	const (
+		uid  int64  = 1<<53 + 1 // float64无法表示
+		big  uint64 = 1<<64 - 1
+		body        = `{"uid":9007199254740993,"big":18446744073709551615,"uids":[9007199254740993,2],"price":"1.50","raw":1.50}`
+	)
+
+	mux := NewMux()
+	handler := func(c *Context, res map[string]interface{}) Error {
+		var (
+			puid, ouid int64
+			pbig       uint64
+			uids       []int64
+			suid, raw  string
+			bound      struct {
+				Uid int64  `json:"uid"`
+				Big uint64 `json:"big"`
+			}
+		)
+
+		if e := c.Parse("uid", &puid, "big", &pbig, "uids", &uids, "uid", &suid, "raw", &raw); e != nil {
+			return NewFailure(1001, "parse", e.Error())
+		}
+		if e := c.ParseOpt("uid", &ouid, int64(0)); e != nil {
+			return NewFailure(1002, "parse opt", e.Error())
+		}
+		if e := c.DecodeJson(&bound); e != nil {
+			return NewFailure(1003, "decode", e.Error())
+		}
+
+		res["got"] = fmt.Sprint(puid, pbig, uids, suid, raw, ouid, bound.Uid, bound.Big)
+		res["uid"] = puid
+		res["big"] = pbig
+		return nil
+	}
+
+	want := fmt.Sprint(uid, big, []int64{uid, 2}, "9007199254740993", "1.50", uid, uid, big)
+	for _, path := range []string{"/t/uid", "/i/uid", "/x/uid"} {
+		mux.Handle(path, handler, nil)
+		mux.Handle(path+"/stream", handler, &RouteConfig{Stream: true})
+	}
+
+	eg := newTestEngine(mux)
+	for _, path := range []string{"/t/uid", "/i/uid", "/x/uid"} {
+		for _, p := range []string{path, path + "/stream"} {
+			w := serve(eg, p, body)
+			if got := w.Body.String(); !strings.Contains(got, `"got":"`+want+`"`) ||
+				!strings.Contains(got, `"uid":9007199254740993`) || !strings.Contains(got, `"big":18446744073709551615`) {
+				t.Errorf("%v = %s, want %s", p, got, want)
+			}
+
+			// protobuf响应中超出double精度的整数为字符串
+			w = httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, p, strings.NewReader(body))
+			r.Header.Set("Content-Type", "application/json")
+			r.Header.Set("Accept", "application/x-protobuf")
+			eg.ServeHTTP(w, r)
+
+			res := make(map[string]interface{})
+			if e := (protobufCodec{}).Unmarshal(w.Body.Bytes(), res); e != nil || res["got"] != want ||
+				res["uid"] != "9007199254740993" || res["big"] != "18446744073709551615" {
+				t.Errorf("%v protobuf = %v, %v", p, res, e)
+			}
+		}
+	}
+}
@@ -1,5 +1,5 @@
 /*
-简易的Http框架，以json为传输格式。
+简易的Http框架，默认以json为传输格式, 也支持msgpack、protobuf(见Codec)。
 
 错误返回值：
 	{
@@ -14,30 +14,65 @@ package mengine
 import (
 	oscontext "context"
 	"fmt"
-	"github.com/wxiaowar/mengine/json"
 	"github.com/wxiaowar/mlog"
-	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type HFunc func(c *Context, res map[string]interface{}) Error
 
+// Middleware 包装HFunc, 在通道检测之后、业务处理之前执行; 先Use的在外层
+type Middleware func(h HFunc) HFunc
+
 type EngionOption struct {
 	Addr    string
 	IsDebug bool
 
+	// 可信代理的IP或CIDR, 只有来自这些地址的X-Forwarded-For/X-Real-IP/Forwarded才会被采信; 条目非法时NewEngine会panic
+	TrustedProxies []string
+
 	CheckWhiteList func(ctx *Context) (e error)             // 检测是IP白名单
 	CheckIntegrity func(ctx *Context) (e error)             // 验证完整性
 	Descrypt       func(ctx *Context) (bts []byte, e error) // 解密验证
-	Encrypt        func(bts []byte) (edbts []byte)          // 加密
+	Encrypt        func(bts []byte) (edbts []byte)          // 加密, 已废弃, 请使用EncryptCtx
+
+	// 加密(v2), 可按请求选择密钥并返回错误; 未设置时由Encrypt适配
+	EncryptCtx func(ctx *Context, bts []byte) (edbts []byte, e error)
+
+	MTLS  *MTLSOption  // 双向TLS, 为nil时不校验客户端证书
+	Certs *CertManager // 服务端证书, 为nil时RunTLS按certFile/keyFile创建并自动重新加载
+
+	ShutdownTimeout time.Duration // RunUntilSignal等待处理中请求的时间, 默认30秒
+	ReadinessGrace  time.Duration // 关闭时readyz失败后继续接收请求的时间, 让探针和负载均衡摘除实例; 计入关闭的超时
+
+	MetricsPath string // 指标路径, 如"/metrics", 为空时不统计; 只对CheckWhiteList通过的请求开放
+
+	TraceExporter SpanExporter // 为nil时不创建span
+
+	Compression *CompressOption // 响应压缩, 为nil时不压缩
+	MaxBodySize int64           // 压缩请求解压后的大小上限, 默认32M
 }
 
 type Engine struct {
 	*EngionOption
 	Router
 	*mlog.MLog
-	svr *http.Server
+	Metrics *Metrics
+	svr     *http.Server
+	proxies *WhiteList
+	mws     []Middleware
+	encrypt func(ctx *Context, bts []byte) ([]byte, error) // EncryptCtx, 未设置时由Encrypt适配
+	certs   *CertManager                                   // RunTLS使用的证书, EngionOption.Certs或按certFile/keyFile创建
+
+	mu       sync.Mutex
+	hooks    []shutdownHook
+	checks   []HealthCheck
+	draining int32
+	drain    chan struct{}        // 开始关闭时关闭, 通知SSE等长连接结束
+	wsconns  map[*WSConn]struct{} // 已升级的WebSocket连接, 关闭时等待其处理函数返回
 }
 
 //
@@ -46,15 +81,44 @@ func NewEngine(opt *EngionOption, log *mlog.MLog, r Router) *Engine {
 		EngionOption: opt,
 		MLog:         log,
 		Router:       r,
+		drain:        make(chan struct{}),
+	}
+
+	proxies, e := NewWhiteList(opt.TrustedProxies...)
+	if e != nil { // 配置错误时忽略会导致无法识别客户端IP, 启动时即失败
+		panic(fmt.Sprintf("invalid trusted proxies: %v", e))
+	}
+	eg.proxies = proxies
+
+	if opt.MetricsPath != "" {
+		eg.Metrics = NewMetrics()
+	}
+
+	eg.encrypt = opt.EncryptCtx
+	if eg.encrypt == nil && opt.Encrypt != nil { // 兼容旧的加密接口, 不修改调用方的opt
+		encrypt := opt.Encrypt
+		eg.encrypt = func(ctx *Context, bts []byte) ([]byte, error) {
+			return encrypt(bts), nil
+		}
 	}
 
-	// TODO pool reduice gc count
-	//eg.pool.New = func() interface{} {
-	//	return &Context{}
-	//}
 	return eg
 }
 
+// Use 添加中间件, 需在Run之前调用
+func (eg *Engine) Use(mws ...Middleware) {
+	eg.mws = append(eg.mws, mws...)
+}
+
+//
+func (eg *Engine) wrap(h HFunc) HFunc {
+	for i := len(eg.mws) - 1; i >= 0; i-- {
+		h = eg.mws[i](h)
+	}
+
+	return h
+}
+
 // ServeHTTP conforms to the http.Handler interface.
 func (eg *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// 跨域问题
@@ -66,28 +130,60 @@ func (eg *Engine) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	w.Header().Add("Access-Control-Allow-Headers", "Content-Type") //header的类型
 	w.Header().Set("Content-Type", "application/json;charset=utf-8")
 
+	if eg.serveHealth(w, req) {
+		return
+	}
+
+	if eg.Metrics != nil && req.URL.Path == eg.MetricsPath {
+		eg.serveMetrics(w, req)
+		return
+	}
+
 	h, b := eg.Rout(req.URL.Path)
 	if !b {
-		eg.comfail(w, "invalid path", req.URL.Path)
+		eg.comfail(w, req, "invalid path", "invalid path")
 		return
 	}
+	h = eg.wrap(h)
+	rc := eg.routeConfig(req.URL.Path)
 
 	itype := req.URL.Path[1]
+	if rc.Timeout > 0 && !rc.persistent {
+		c, cancel := oscontext.WithTimeout(req.Context(), rc.Timeout)
+		defer cancel()
+		req = req.WithContext(c)
+	}
+
+	if span := eg.startSpan(req); span != nil {
+		span.SetAttr("route", req.URL.Path)
+		span.SetAttr("itype", string(itype))
+		span.SetAttr("method", req.Method)
+		req = withSpan(w, req, span)
+		defer span.Finish()
+	}
+
+	if e := eg.checkClientCert(itype, req); e != nil {
+		ctx := eg.acquire(w, req, rc)
+		eg.reject(ctx, w, authfailure("client cert", e.Error()))
+		eg.release(ctx)
+		return
+	}
+
 	switch itype {
 	case 't':
-		eg.trustHandle(h, w, req)
+		eg.trustHandle(h, rc, w, req)
 		break
 
 	case 'i':
-		eg.itgHandle(h, w, req)
+		eg.itgHandle(h, rc, w, req)
 		break
 
 	case 'x':
-		eg.encHandle(h, w, req)
+		eg.encHandle(h, rc, w, req)
 		break
 
 	default:
-		eg.comfail(w, "invalid itype", req.URL.Path)
+		eg.comfail(w, req, "invalid itype", "invalid itype")
 	}
 }
 
@@ -101,22 +197,20 @@ func (eg *Engine) Run() error {
 		MaxHeaderBytes: 0,
 	}
 
-	eg.svr = s
+	if !eg.setServer(s) {
+		return http.ErrServerClosed
+	}
 
 	return s.ListenAndServe()
 }
 
-// ShutDown graceful shutdown
+// ShutDown graceful shutdown, 等待处理中的请求最多duration, 然后执行OnShutdown注册的回调
 func (eg *Engine) ShutDown(duration time.Duration) error {
-	if eg.svr != nil {
-		ctx, _ := oscontext.WithTimeout(oscontext.Background(), duration*time.Second)
-		return eg.svr.Shutdown(ctx)
-	}
-
-	return nil
+	_, e := eg.shutdown(duration)
+	return e
 }
 
-//
+// RunTLS 证书文件变化后自动重新加载, 无需重启
 func (eg *Engine) RunTLS(addr, certFile, keyFile string) error {
 	s := &http.Server{
 		Addr:           eg.Addr,
@@ -126,57 +220,60 @@ func (eg *Engine) RunTLS(addr, certFile, keyFile string) error {
 		MaxHeaderBytes: 0,
 	}
 
-	eg.svr = s
-	return s.ListenAndServeTLS(certFile, keyFile)
-}
-
-//
-func readbody(r *http.Request) (bts []byte, bmap map[string]interface{}, e error) {
-	bts, e = ioutil.ReadAll(r.Body)
+	cfg, e := eg.tlsConfig()
 	if e != nil {
-		return
+		return e
 	}
 
-	bmap = make(map[string]interface{})
-	if len(bts) <= 0 { // len <= 0, no need unmarshal
-		return
+	certs := eg.Certs
+	if certs == nil { // 不修改调用方的opt
+		certs = NewCertManager(eg.MLog)
+		if e = certs.Add(certFile, keyFile); e != nil {
+			return e
+		}
+
+		stop := certs.Watch(time.Minute)
+		defer stop()
 	}
 
-	// body按照json格式解析
-	if e = json.Unmarshal(bts, &bmap); e != nil {
-		return
+	eg.mu.Lock()
+	eg.certs = certs
+	eg.mu.Unlock()
+
+	cfg.GetCertificate = certs.GetCertificate
+	s.TLSConfig = cfg
+
+	if !eg.setServer(s) {
+		return http.ErrServerClosed
 	}
 
-	return bts, bmap, nil
+	return s.ListenAndServeTLS("", "")
 }
 
 // local server
-func (eg *Engine) trustHandle(h HFunc, w http.ResponseWriter, r *http.Request) {
-	bts, bmap, e := readbody(r)
-	if e != nil {
-		eg.comfail(w, fmt.Sprint("readbody error %v", e), r.URL.Path)
+func (eg *Engine) trustHandle(h HFunc, rc *RouteConfig, w http.ResponseWriter, r *http.Request) {
+	ctx := eg.acquire(w, r, rc)
+	defer eg.release(ctx)
+
+	if rc.Stream { // 白名单只校验IP, body留给处理函数读取
+		ctx.body = bodyStream
+	} else if e := eg.readbody(ctx); e != nil {
+		eg.reject(ctx, w, comfailure("readbody", fmt.Sprintf("readbody error: %v", e)))
 		return
 	}
 
 	if eg.CheckWhiteList == nil { // 本地白名单检测
-		eg.comfail(w, "check white handle nil", r.URL.Path)
+		eg.reject(ctx, w, comfailure("check white handle nil", "check white handle nil"))
 		return
 	}
 
 	if len(r.URL.Path) < 3 {
-		eg.comfail(w, "invalid url formate", r.URL.Path)
+		eg.reject(ctx, w, comfailure("invalid url formate", "invalid url formate"))
 		return
 	}
 
-	// TODO use sync.pool reduice gc
-	ctx := &Context{
-		Request: r,
-		Body:    bmap,
-		BodyRaw: bts,
-	}
-
-	if e = eg.CheckWhiteList(ctx); e != nil {
-		eg.authfail(w, fmt.Sprintf("check white error %v", e), r.URL.Path)
+	if e := eg.CheckWhiteList(ctx); e != nil {
+		eg.reject(ctx, w, authfailure("check white", fmt.Sprintf("check white error: %v", e)))
 		return
 	}
 
@@ -184,27 +281,22 @@ func (eg *Engine) trustHandle(h HFunc, w http.ResponseWriter, r *http.Request) {
 }
 
 //
-func (eg *Engine) itgHandle(h HFunc, w http.ResponseWriter, r *http.Request) {
-	bts, bmap, e := readbody(r)
-	if e != nil {
-		eg.comfail(w, fmt.Sprintf("readbody error %v", e), r.URL.Path)
+func (eg *Engine) itgHandle(h HFunc, rc *RouteConfig, w http.ResponseWriter, r *http.Request) {
+	ctx := eg.acquire(w, r, rc)
+	defer eg.release(ctx)
+
+	if e := eg.readbody(ctx); e != nil {
+		eg.reject(ctx, w, comfailure("readbody", fmt.Sprintf("readbody error: %v", e)))
 		return
 	}
 
 	if eg.CheckIntegrity == nil {
-		eg.comfail(w, "check integrity handle nil", r.URL.Path)
+		eg.reject(ctx, w, comfailure("check integrity handle nil", "check integrity handle nil"))
 		return
 	}
 
-	// TODO use sync.pool reduice gc
-	ctx := &Context{
-		Request: r,
-		Body:    bmap,
-		BodyRaw: bts,
-	}
-
 	if e := eg.CheckIntegrity(ctx); e != nil {
-		eg.authfail(w, fmt.Sprintf("invalid integrity msg %v", e), r.URL.Path)
+		eg.reject(ctx, w, authfailure("invalid integrity", fmt.Sprintf("invalid integrity msg: %v", e)))
 		return
 	}
 
@@ -213,8 +305,34 @@ func (eg *Engine) itgHandle(h HFunc, w http.ResponseWriter, r *http.Request) {
 
 //
 func (eg *Engine) handle(h HFunc, ctx *Context, w http.ResponseWriter) {
-	res := make(map[string]interface{})
-	se := h(ctx, res)
+	res := acquireResult()
+	se := eg.call(h, ctx, res)
+	if f, ok := se.(*Failure); ok && f == nil { // 返回了nil的*Failure, 按成功处理
+		se = nil
+	}
+	if !ctx.detached { // 超时后res仍由处理函数持有
+		defer releaseResult(res)
+	}
+
+	if atomic.LoadInt32(&ctx.streamed) == 1 { // SSE/WebSocket已接管响应, 错误已作为消息发送
+		var code int32
+		if se != nil {
+			code = se.Code()
+		}
+		eg.Metrics.observe(ctx, code, 0)
+		ctx.Span().SetAttr("code", strconv.Itoa(int(code)))
+		return
+	}
+
+	if !ctx.detached && ctx.bodyErr != nil { // EnsureBody无法返回错误, body解析失败时不使用处理结果
+		eg.reject(ctx, w, comfailure("readbody", fmt.Sprintf("readbody error: %v", ctx.bodyErr)))
+		return
+	}
+
+	if f, ok := se.(*Failure); ok { // 中间件拒绝
+		eg.reject(ctx, w, f)
+		return
+	}
 
 	var (
 		code   int32  = 0
@@ -236,13 +354,22 @@ func (eg *Engine) handle(h HFunc, ctx *Context, w http.ResponseWriter) {
 		res["detail"] = detail
 	}
 
-	rbts, err := json.Marshal(res)
+	c := responseCodec(ctx.Request)
+	rbts, err := c.Marshal(res)
 	if err != nil {
-		eg.comfail(w, fmt.Sprint("marshal write error : %v", err), ctx.Path())
+		eg.reject(ctx, w, comfailure("marshal", fmt.Sprintf("marshal write error: %v", err)))
 		return
 	}
+	w.Header().Set("Content-Type", c.ContentType())
+
+	out, encoding := eg.compress(ctx, rbts)
+	if encoding != "" {
+		w.Header().Set("Content-Encoding", encoding)
+	}
 
-	_, err = w.Write(rbts)
+	_, err = w.Write(out)
+	eg.Metrics.observe(ctx, code, len(out))
+	ctx.Span().SetAttr("code", strconv.Itoa(int(code)))
 	if err != nil {
 		eg.Error().Str("status", "ok").
 			Int("code", -1).
@@ -263,27 +390,59 @@ func (eg *Engine) handle(h HFunc, ctx *Context, w http.ResponseWriter) {
 		Str("return", string(rbts))
 }
 
-func (eg *Engine) authfail(w http.ResponseWriter, detail, path string) {
-	eg.fail(w, -2, detail, path)
+// authfailure/comfailure 引擎自身的失败, reason用于指标
+func authfailure(reason, detail string) *Failure {
+	return NewFailure(CodeAuth, "internal", detail).WithReason(reason)
 }
 
-func (eg *Engine) comfail(w http.ResponseWriter, detail, path string) {
-	eg.fail(w, -1, detail, path)
+func comfailure(reason, detail string) *Failure {
+	return NewFailure(CodeInternal, "internal", detail).WithReason(reason)
 }
 
-func (eg *Engine) fail(w http.ResponseWriter, code int, detail, path string) {
+func (eg *Engine) authfail(w http.ResponseWriter, r *http.Request, reason, detail string) {
+	eg.fail(w, r, authfailure(reason, detail))
+}
+
+func (eg *Engine) comfail(w http.ResponseWriter, r *http.Request, reason, detail string) {
+	eg.fail(w, r, comfailure(reason, detail))
+}
+
+// reject 已路由的请求失败, 除失败外同时计入请求数
+func (eg *Engine) reject(ctx *Context, w http.ResponseWriter, f *Failure) {
+	eg.fail(w, ctx.Request, f)
+	eg.Metrics.observe(ctx, f.Code(), 0)
+}
+
+func (eg *Engine) fail(w http.ResponseWriter, r *http.Request, f *Failure) {
+	code, detail := int(f.Code()), f.Detail()
 	result := map[string]interface{}{
 		"code": code,
-		"msg":  "internal",
+		"msg":  f.Msg(),
 	}
 
 	if eg.IsDebug {
 		result["detail"] = detail
 	}
 
+	eg.Metrics.fail(failKind(code), code, f.Reason())
+	spanFrom(r).SetAttr("code", strconv.Itoa(code))
 	eg.Error().Str("status", "fail").
 		Int("code", code).
-		Str("path", path).Str("detail", detail)
-	res, _ := json.Marshal(result)
+		Str("path", r.URL.Path).Str("detail", detail)
+	c := responseCodec(r)
+	res, _ := c.Marshal(result)
+	w.Header().Set("Content-Type", c.ContentType())
 	w.Write(res)
 }
+
+// failKind 指标中的失败类型
+func failKind(code int) string {
+	switch code {
+	case CodeInternal:
+		return "comfail"
+	case CodeAuth:
+		return "authfail"
+	default:
+		return "reject"
+	}
+}
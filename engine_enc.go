@@ -1,52 +1,82 @@
 package mengine
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/wxiaowar/mengine/json"
-	"io/ioutil"
 	"net/http"
+	"strconv"
 	"time"
 )
 
-func (eg *Engine) encHandle(h HFunc, w http.ResponseWriter, r *http.Request) {
-	bts, e := ioutil.ReadAll(r.Body)
-	if e != nil {
-		eg.encfail(w, fmt.Sprint("readbody error %v", e), r.URL.Path)
+func (eg *Engine) encHandle(h HFunc, rc *RouteConfig, w http.ResponseWriter, r *http.Request) {
+	ctx := eg.acquire(w, r, rc)
+	defer eg.release(ctx)
+
+	buf := bufferPool.Get().(*bytes.Buffer)
+	ctx.buf = buf
+	if _, e := buf.ReadFrom(r.Body); e != nil {
+		eg.encfail(ctx, w, "readbody", fmt.Sprintf("readbody error: %v", e))
 		return
 	}
 
 	if eg.Descrypt == nil {
-		eg.encfail(w, "descrypt handle nil", r.URL.Path)
+		eg.encfail(ctx, w, "descrypt handle nil", "descrypt handle nil")
 		return
 	}
 
-	ctx := &Context{
-		Request: r,
-		BodyRaw: bts,
-	}
+	ctx.BodyRaw = buf.Bytes()
 
 	decbts, e := eg.Descrypt(ctx)
 	if e != nil {
-		eg.encfail(w, fmt.Sprintf("check descrypt error %v", e), r.URL.Path)
+		eg.encfail(ctx, w, "check descrypt", fmt.Sprintf("check descrypt error: %v", e))
 		return
 	}
 
 	ctx.BodyRaw = decbts
 
-	bmap := make(map[string]interface{}) // body按照json格式解析
-	if len(ctx.BodyRaw) > 0 {
-		if e := json.Unmarshal(ctx.BodyRaw, &bmap); e != nil {
-			eg.encfail(w, fmt.Sprintf("read umarsh error %v", e), r.URL.Path)
+	// 客户端先压缩再加密, 解密后再解压; 与响应一致优先取X-Content-Encoding
+	encoding := r.Header.Get("X-Content-Encoding")
+	if encoding == "" {
+		encoding = r.Header.Get("Content-Encoding")
+	}
+
+	if encoding != "" {
+		plain := &bytes.Buffer{}
+		if e := eg.inflate(plain, bytes.NewReader(decbts), encoding); e != nil {
+			eg.encfail(ctx, w, "inflate", fmt.Sprintf("inflate error: %v", e))
 			return
 		}
+		ctx.BodyRaw = plain.Bytes()
+	}
+
+	if e := ctx.parseLater(); e != nil { // body按照Content-Type解析
+		eg.encfail(ctx, w, "read umarsh", fmt.Sprintf("read umarsh error: %v", e))
+		return
 	}
 
 	eg.handleEnc(h, ctx, w)
 }
 
 func (eg *Engine) handleEnc(h HFunc, ctx *Context, w http.ResponseWriter) {
-	res := make(map[string]interface{})
-	se := h(ctx, res)
+	res := acquireResult()
+	se := eg.call(h, ctx, res)
+	if f, ok := se.(*Failure); ok && f == nil { // 返回了nil的*Failure, 按成功处理
+		se = nil
+	}
+	if !ctx.detached { // 超时后res仍由处理函数持有
+		defer releaseResult(res)
+	}
+
+	if !ctx.detached && ctx.bodyErr != nil { // EnsureBody无法返回错误, body解析失败时不使用处理结果
+		eg.encfail(ctx, w, "readbody", fmt.Sprintf("readbody error: %v", ctx.bodyErr))
+		return
+	}
+
+	if f, ok := se.(*Failure); ok { // 中间件拒绝
+		eg.encfailure(ctx, w, f)
+		eg.Metrics.observe(ctx, f.Code(), 0)
+		return
+	}
 
 	var (
 		code   int32  = 0
@@ -68,20 +98,34 @@ func (eg *Engine) handleEnc(h HFunc, ctx *Context, w http.ResponseWriter) {
 		res["detail"] = detail
 	}
 
-	rbts, err := json.Marshal(res)
+	c := responseCodec(ctx.Request)
+	rbts, err := c.Marshal(res)
 	if err != nil {
-		eg.encfail(w, fmt.Sprint("marshal write error : %v", err), ctx.Path())
+		eg.encfail(ctx, w, "marshal", fmt.Sprintf("marshal write error: %v", err))
 		return
 	}
+	w.Header().Set("Content-Type", c.ContentType())
 
-	if eg.Encrypt == nil {
-		eg.encfail(w, "encrypt handle nil", ctx.Path())
+	if eg.encrypt == nil {
+		eg.encfail(ctx, w, "encrypt handle nil", "encrypt handle nil")
 		return
 	}
 
-	rtbts := eg.Encrypt(rbts)
+	// 先压缩再加密, 密文不能再用Content-Encoding, 由X-Content-Encoding告知客户端解密后再解压
+	zbts, encoding := eg.compress(ctx, rbts)
+	rtbts, err := eg.encrypt(ctx, zbts)
+	if err != nil { // 加密失败不能输出明文结果
+		eg.encfail(ctx, w, "encrypt", fmt.Sprintf("encrypt error: %v", err))
+		return
+	}
+
+	if encoding != "" { // 加密成功后才设置, 失败时的错误返回没有压缩
+		w.Header().Set("X-Content-Encoding", encoding)
+	}
 
 	_, err = w.Write(rtbts)
+	eg.Metrics.observe(ctx, code, len(rtbts))
+	ctx.Span().SetAttr("code", strconv.Itoa(int(code)))
 	if err != nil {
 		eg.Error().Str("status", "ok").
 			Int("code", -1).
@@ -102,23 +146,46 @@ func (eg *Engine) handleEnc(h HFunc, ctx *Context, w http.ResponseWriter) {
 		Str("return", string(rbts))
 }
 
-func (eg *Engine) encfail(w http.ResponseWriter, detail, path string) {
+// encfail 加密通道的错误返回, 错误信息同样加密; 无法加密时只返回http 500, 不输出明文
+func (eg *Engine) encfail(ctx *Context, w http.ResponseWriter, reason, detail string) {
+	f := comfailure(reason, detail)
+	eg.encfailure(ctx, w, f)
+	eg.Metrics.observe(ctx, f.Code(), 0)
+}
+
+//
+func (eg *Engine) encfailure(ctx *Context, w http.ResponseWriter, f *Failure) {
 	result := map[string]interface{}{
-		"code": -1,
-		"msg":  "internal",
+		"code": f.Code(),
+		"msg":  f.Msg(),
 	}
 
 	if eg.IsDebug {
-		result["detail"] = detail
+		result["detail"] = f.Detail()
 	}
 
+	eg.Metrics.fail("encfail", int(f.Code()), f.Reason())
+	ctx.Span().SetAttr("code", strconv.Itoa(int(f.Code())))
 	eg.Error().Str("status", "fail").
-		Int("code", -1).
-		Str("path", path).Str("detail", detail)
+		Int("code", int(f.Code())).
+		Str("path", ctx.Path()).Str("detail", f.Detail()).Msg("encfail")
+
+	if eg.encrypt == nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	res, _ := json.Marshal(result)
-	if eg.Encrypt != nil {
-		res = eg.Encrypt(res)
+	c := responseCodec(ctx.Request)
+	res, _ := c.Marshal(result)
+	w.Header().Set("Content-Type", c.ContentType())
+	w.Header().Del("X-Content-Encoding") // 错误返回不压缩
+	res, e := eg.encrypt(ctx, res)
+	if e != nil {
+		eg.Error().Str("status", "fail").
+			Int("code", CodeInternal).
+			Str("path", ctx.Path()).Str("detail", e.Error()).Msg("encrypt fail response error")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
 	}
 
 	w.Write(res)
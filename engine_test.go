@@ -0,0 +1,26 @@
+package mengine
+
+import (
+	"github.com/wxiaowar/mlog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// newTestEngine 白名单和完整性校验都通过, 加密为原样返回
+func newTestEngine(mux *Mux) *Engine {
+	return NewEngine(&EngionOption{
+		CheckWhiteList: func(ctx *Context) error { return nil },
+		CheckIntegrity: func(ctx *Context) error { return nil },
+		Descrypt:       func(ctx *Context) ([]byte, error) { return ctx.BodyRaw, nil },
+		EncryptCtx:     func(ctx *Context, bts []byte) ([]byte, error) { return bts, nil },
+	}, &mlog.MLog{}, mux)
+}
+
+func serve(eg *Engine, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	eg.ServeHTTP(w, r)
+	return w
+}
@@ -5,3 +5,78 @@ type Error interface {
 	Msg() string
 	Detail() string
 }
+
+// 引擎自身使用的错误码, 业务错误码应为正数
+const (
+	CodeInternal  = -1 // 内部错误, comfail/encfail
+	CodeAuth      = -2 // 认证失败, authfail
+	CodeForbidden = -3 // 权限不足
+	CodeTimeout   = -4 // 处理超时
+	CodeRateLimit = -5 // 请求过于频繁
+	CodeBusy      = -6 // 服务繁忙, 客户端应退避重试
+)
+
+// Failure 由中间件返回以中止请求, engine按fail的格式输出, 不带处理结果
+type Failure struct {
+	code   int32
+	msg    string
+	detail string
+	reason string
+}
+
+//
+func NewFailure(code int32, msg, detail string) *Failure {
+	return &Failure{code: code, msg: msg, detail: detail}
+}
+
+// AuthFailure 认证失败, 等同authfail
+func AuthFailure(detail string) *Failure {
+	return NewFailure(CodeAuth, "internal", detail).WithReason("auth")
+}
+
+// ForbiddenFailure 已认证但权限不足
+func ForbiddenFailure(detail string) *Failure {
+	return NewFailure(CodeForbidden, "forbidden", detail)
+}
+
+func (f *Failure) Code() int32 {
+	return f.code
+}
+
+func (f *Failure) Msg() string {
+	return f.msg
+}
+
+func (f *Failure) Detail() string {
+	return f.detail
+}
+
+// WithReason 设置指标中的失败原因, 应为有限的几个常量, 不能包含请求相关的内容
+func (f *Failure) WithReason(reason string) *Failure {
+	f.reason = reason
+	return f
+}
+
+// Reason 指标中的失败原因, 未设置时为msg
+func (f *Failure) Reason() string {
+	if f.reason == "" {
+		return f.msg
+	}
+
+	return f.reason
+}
+
+// TimeoutFailure 处理超过路由的超时时间
+func TimeoutFailure(detail string) *Failure {
+	return NewFailure(CodeTimeout, "timeout", detail)
+}
+
+// RateLimitFailure 超过限流配额
+func RateLimitFailure(detail string) *Failure {
+	return NewFailure(CodeRateLimit, "too many requests", detail)
+}
+
+// BusyFailure 并发已满, 请求被拒绝
+func BusyFailure(detail string) *Failure {
+	return NewFailure(CodeBusy, "server busy", detail)
+}
@@ -0,0 +1,146 @@
+package mengine
+
+import (
+	oscontext "context"
+	"github.com/wxiaowar/mengine/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 探活路径, 不经过itype分发
+const (
+	HealthzPath = "/healthz" // 存活, 进程能处理请求即成功
+	ReadyzPath  = "/readyz"  // 就绪, 执行健康检查, 关闭开始后立即失败(见ReadinessGrace); CheckWhiteList通过时才返回失败原因
+)
+
+// HealthCheck 健康检查, Critical为true时失败会使readyz失败, 否则只在结果中报告
+type HealthCheck struct {
+	Name     string
+	Timeout  time.Duration // 默认3秒
+	Critical bool
+	Check    func(ctx oscontext.Context) error
+}
+
+// AddHealthCheck 注册健康检查
+func (eg *Engine) AddHealthCheck(hc HealthCheck) {
+	if hc.Timeout <= 0 {
+		hc.Timeout = 3 * time.Second
+	}
+
+	eg.mu.Lock()
+	eg.checks = append(eg.checks, hc)
+	eg.mu.Unlock()
+}
+
+// serveHealth 处理探活请求, 返回false表示不是探活路径
+func (eg *Engine) serveHealth(w http.ResponseWriter, r *http.Request) bool {
+	switch r.URL.Path {
+	case HealthzPath:
+		writeHealth(w, http.StatusOK, map[string]interface{}{
+			"code": 0,
+			"msg":  "success",
+		})
+		return true
+
+	case ReadyzPath:
+		eg.ready(w, r)
+		return true
+	}
+
+	return false
+}
+
+func (eg *Engine) ready(w http.ResponseWriter, r *http.Request) {
+	if eg.Draining() {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"code": CodeInternal,
+			"msg":  "shutting down",
+		})
+		return
+	}
+
+	eg.mu.Lock()
+	checks := append([]HealthCheck(nil), eg.checks...)
+	eg.mu.Unlock()
+
+	errs := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = runCheck(r.Context(), checks[i])
+		}(i)
+	}
+	wg.Wait()
+
+	ok := true
+	trusted := eg.trusted(w, r)
+	details := make(map[string]interface{}, len(checks))
+	for i, hc := range checks {
+		if errs[i] == nil {
+			details[hc.Name] = "ok"
+			continue
+		}
+
+		details[hc.Name] = "fail"
+		if trusted { // 依赖的错误可能包含地址、账号等, 不对外暴露
+			details[hc.Name] = errs[i].Error()
+		}
+		if hc.Critical {
+			ok = false
+		}
+	}
+
+	if !ok {
+		writeHealth(w, http.StatusServiceUnavailable, map[string]interface{}{
+			"code":   CodeInternal,
+			"msg":    "not ready",
+			"checks": details,
+		})
+		return
+	}
+
+	writeHealth(w, http.StatusOK, map[string]interface{}{
+		"code":   0,
+		"msg":    "success",
+		"checks": details,
+	})
+}
+
+// trusted 请求是否通过CheckWhiteList, 未设置时为false
+func (eg *Engine) trusted(w http.ResponseWriter, r *http.Request) bool {
+	if eg.CheckWhiteList == nil {
+		return false
+	}
+
+	ctx := eg.acquire(w, r, emptyRouteConfig)
+	defer eg.release(ctx)
+
+	return eg.CheckWhiteList(ctx) == nil
+}
+
+// runCheck 超时后不再等待检查函数返回
+func runCheck(parent oscontext.Context, hc HealthCheck) error {
+	ctx, cancel := oscontext.WithTimeout(parent, hc.Timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- hc.Check(ctx)
+	}()
+
+	select {
+	case e := <-done:
+		return e
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func writeHealth(w http.ResponseWriter, status int, result map[string]interface{}) {
+	res, _ := json.Marshal(result)
+	w.WriteHeader(status)
+	w.Write(res)
+}
@@ -0,0 +1,45 @@
+package mengine
+
+import (
+	oscontext "context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// readyz只对白名单内的请求返回检查的错误
+func TestReadyzDetails(t *testing.T) {
+	eg := newTestEngine(NewMux())
+	eg.AddHealthCheck(HealthCheck{Name: "db", Critical: true, Check: func(ctx oscontext.Context) error {
+		return errors.New("dial tcp 10.1.2.3:3306: refused")
+	}})
+	eg.AddHealthCheck(HealthCheck{Name: "cache", Check: func(ctx oscontext.Context) error {
+		return nil
+	}})
+
+	ready := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		eg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ReadyzPath, nil))
+		return w
+	}
+
+	w := ready()
+	if w.Code != http.StatusServiceUnavailable || !strings.Contains(w.Body.String(), "10.1.2.3") {
+		t.Errorf("whitelisted readyz = %v %s, want details", w.Code, w.Body.String())
+	}
+
+	eg.CheckWhiteList = func(ctx *Context) error { return errors.New("denied") }
+	w = ready()
+	body := w.Body.String()
+	if w.Code != http.StatusServiceUnavailable || strings.Contains(body, "10.1.2.3") ||
+		!strings.Contains(body, `"db":"fail"`) || !strings.Contains(body, `"cache":"ok"`) {
+		t.Errorf("public readyz = %v %s, want only ok/fail", w.Code, body)
+	}
+
+	eg.CheckWhiteList = nil
+	if body = ready().Body.String(); strings.Contains(body, "10.1.2.3") {
+		t.Errorf("readyz without whitelist = %s, want no details", body)
+	}
+}
@@ -1,13 +1,144 @@
-// +build !jsoniter
-
 package json
 
-import "encoding/json"
+import (
+	stdjson "encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// jsoniter在UseNumber时同样解析为encoding/json.Number
+type Number = stdjson.Number
+
+// Decoder.Token返回的类型, 与encoding/json相同
+type (
+	Token = stdjson.Token
+	Delim = stdjson.Delim
+)
+
+// Engine json的实现, std总是注册, jsoniter在 -tags=jsoniter 时注册并作为默认, 可在启动时用Use切换
+type Engine interface {
+	Name() string
+	Marshal(v interface{}) ([]byte, error)
+	MarshalIndent(v interface{}, prefix, indent string) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	NewEncoder(w io.Writer) Encoder
+	NewDecoder(r io.Reader) Decoder
+}
+
+type Encoder interface {
+	Encode(v interface{}) error
+	SetIndent(prefix, indent string)
+	SetEscapeHTML(on bool)
+}
+
+type Decoder interface {
+	Decode(v interface{}) error
+	Token() (Token, error)
+	UseNumber()
+	DisallowUnknownFields()
+	More() bool
+	Buffered() io.Reader
+}
 
 var (
-	Marshal       = json.Marshal
-	Unmarshal     = json.Unmarshal
-	MarshalIndent = json.MarshalIndent
-	NewEncoder    = json.NewEncoder
-	NewDecoder    = json.NewDecoder
+	mu      sync.Mutex
+	engines = map[string]Engine{"std": stdEngine{}}
+	current atomic.Value // holder, atomic.Value要求每次存入相同的具体类型
 )
+
+type holder struct {
+	Engine
+}
+
+func init() {
+	current.Store(holder{defaultEngine})
+}
+
+// Register 注册实现, 同名覆盖; 包内的一致性测试对所有已注册的实现运行, 新的实现应在其中注册
+func Register(e Engine) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	engines[e.Name()] = e
+}
+
+// Use 切换全局使用的实现, 应在启动时调用
+func Use(name string) error {
+	mu.Lock()
+	defer mu.Unlock()
+
+	e, ok := engines[name]
+	if !ok {
+		return fmt.Errorf("json engine %v not registered", name)
+	}
+
+	current.Store(holder{e})
+	return nil
+}
+
+// Current 当前使用的实现
+func Current() Engine {
+	return current.Load().(holder).Engine
+}
+
+// Engines 已注册的实现名
+func Engines() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+
+	return names
+}
+
+func Marshal(v interface{}) ([]byte, error) {
+	return Current().Marshal(v)
+}
+
+func MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	return Current().MarshalIndent(v, prefix, indent)
+}
+
+func Unmarshal(data []byte, v interface{}) error {
+	return Current().Unmarshal(data, v)
+}
+
+func NewEncoder(w io.Writer) Encoder {
+	return Current().NewEncoder(w)
+}
+
+func NewDecoder(r io.Reader) Decoder {
+	return Current().NewDecoder(r)
+}
+
+// stdEngine encoding/json
+type stdEngine struct{}
+
+func (stdEngine) Name() string {
+	return "std"
+}
+
+func (stdEngine) Marshal(v interface{}) ([]byte, error) {
+	return stdjson.Marshal(v)
+}
+
+func (stdEngine) MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	return stdjson.MarshalIndent(v, prefix, indent)
+}
+
+func (stdEngine) Unmarshal(data []byte, v interface{}) error {
+	return stdjson.Unmarshal(data, v)
+}
+
+func (stdEngine) NewEncoder(w io.Writer) Encoder {
+	return stdjson.NewEncoder(w)
+}
+
+func (stdEngine) NewDecoder(r io.Reader) Decoder {
+	return stdjson.NewDecoder(r)
+}
@@ -0,0 +1,278 @@
+package json
+
+import (
+	"bytes"
+	stdjson "encoding/json"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type conformanceItem struct {
+	Name    string            `json:"name"`
+	Age     int               `json:"age,omitempty"`
+	Tags    []string          `json:"tags"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Raw     []byte            `json:"raw"`
+	Skip    string            `json:"-"`
+	Pointer *int              `json:"pointer"`
+}
+
+// 序列化结果必须与encoding/json完全一致
+var conformanceValues = []interface{}{
+	nil,
+	true,
+	"plain",
+	"<html> &   \"quoted\" 中文",
+	0, -1, int64(1) << 62, uint64(1) << 63,
+	1.5, 1e21, 0.000001, -0.0,
+	Number("12345678901234567890"),
+	[]interface{}{1, "a", nil},
+	[]int(nil),
+	map[string]interface{}{"b": 1, "a": []interface{}{}, "c": map[string]interface{}{}},
+	map[string]int{"z": 1, "y": 2},
+	conformanceItem{Name: "n", Tags: []string{"t"}, Raw: []byte("raw"), Skip: "skip"},
+	&conformanceItem{Age: 3, Attrs: map[string]string{"k": "v"}},
+}
+
+// 解析结果必须与encoding/json一致
+var conformanceInputs = []string{
+	`{}`,
+	`{"a":1,"b":1.5,"c":"s","d":null,"e":true,"f":[1,{"g":[]}]}`,
+	`{"big":12345678901234567890,"exp":1e-7,"neg":-0}`,
+	`{"esc":"中\n\t\"\\\/","dup":1,"dup":2}`,
+	` { "space" : [ 1 , 2 ] } `,
+}
+
+// 必须返回错误
+var conformanceInvalid = []string{
+	``,
+	`{`,
+	`{"a":}`,
+	`{"a":1,}`,
+	`{'a':1}`,
+	`[1,2`,
+	`{"a":"\x"}`,
+}
+
+// forEngines 对每个已注册的实现运行, 新注册的实现自动纳入测试
+func forEngines(t *testing.T, test func(t *testing.T, e Engine)) {
+	names := Engines()
+	sort.Strings(names)
+	for _, name := range names {
+		e := engines[name]
+		t.Run(name, func(t *testing.T) {
+			test(t, e)
+		})
+	}
+}
+
+func TestEngines(t *testing.T) {
+	names := Engines()
+	sort.Strings(names)
+	want := []string{"std"} // jsoniter只在 -tags=jsoniter 时注册
+	if defaultEngine.Name() == "jsoniter" {
+		want = []string{"jsoniter", "std"}
+	}
+	if !reflect.DeepEqual(names, want) || Current().Name() != defaultEngine.Name() {
+		t.Fatalf("Engines() = %v, Current() = %v, want %v", names, Current().Name(), want)
+	}
+
+	defer Use(Current().Name())
+	for _, name := range names {
+		if e := Use(name); e != nil || Current().Name() != name {
+			t.Fatalf("Use(%v) = %v, Current() = %v", name, e, Current().Name())
+		}
+	}
+
+	if e := Use("unknown"); e == nil {
+		t.Fatal("Use(unknown) should fail")
+	}
+}
+
+func TestMarshal(t *testing.T) {
+	forEngines(t, func(t *testing.T, e Engine) {
+		for _, v := range conformanceValues {
+			want, _ := stdjson.Marshal(v)
+			got, err := e.Marshal(v)
+			if err != nil || !bytes.Equal(got, want) {
+				t.Errorf("Marshal(%#v) = %s, %v, want %s", v, got, err, want)
+			}
+
+			for _, indent := range [][2]string{{"", "  "}, {">", "\t"}} {
+				want, _ = stdjson.MarshalIndent(v, indent[0], indent[1])
+				if got, err = e.MarshalIndent(v, indent[0], indent[1]); err != nil || !bytes.Equal(got, want) {
+					t.Errorf("MarshalIndent(%#v, %q, %q) = %s, %v, want %s", v, indent[0], indent[1], got, err, want)
+				}
+			}
+		}
+
+		if _, err := e.Marshal(map[string]interface{}{"ch": make(chan int)}); err == nil {
+			t.Error("Marshal(chan) should fail")
+		}
+	})
+}
+
+func TestUnmarshal(t *testing.T) {
+	forEngines(t, func(t *testing.T, e Engine) {
+		for _, in := range conformanceInputs {
+			var want, got map[string]interface{}
+			stdjson.Unmarshal([]byte(in), &want)
+			if err := e.Unmarshal([]byte(in), &got); err != nil || !reflect.DeepEqual(got, want) {
+				t.Errorf("Unmarshal(%s) = %#v, %v, want %#v", in, got, err, want)
+			}
+		}
+
+		for _, in := range conformanceInvalid {
+			var got map[string]interface{}
+			if err := e.Unmarshal([]byte(in), &got); err == nil {
+				t.Errorf("Unmarshal(%s) should fail", in)
+			}
+		}
+
+		// 解析到已有的map时保留原有的key, Codec.Unmarshal解析到传入的map依赖这一点
+		m := map[string]interface{}{"keep": true}
+		if err := e.Unmarshal([]byte(`{"new":1}`), &m); err != nil || len(m) != 2 || m["keep"] != true {
+			t.Errorf("Unmarshal into existing map = %v, %v", m, err)
+		}
+
+		var item conformanceItem
+		if err := e.Unmarshal([]byte(`{"name":"n","age":3,"raw":"cmF3","pointer":7,"unknown":1}`), &item); err != nil ||
+			item.Name != "n" || item.Age != 3 || string(item.Raw) != "raw" || item.Pointer == nil || *item.Pointer != 7 {
+			t.Errorf("Unmarshal struct = %+v, %v", item, err)
+		}
+
+		if err := e.Unmarshal([]byte(`{"age":"3"}`), &item); err == nil {
+			t.Error("Unmarshal string into int should fail")
+		}
+	})
+}
+
+func TestDecoder(t *testing.T) {
+	forEngines(t, func(t *testing.T, e Engine) {
+		// UseNumber保留原始数字文本
+		dec := e.NewDecoder(strings.NewReader(`{"n":12345678901234567890,"f":1.50} [1] "s"`))
+		dec.UseNumber()
+
+		var body map[string]interface{}
+		if err := dec.Decode(&body); err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		if n, ok := body["n"].(Number); !ok || n.String() != "12345678901234567890" {
+			t.Errorf("UseNumber n = %#v", body["n"])
+		}
+		if f, ok := body["f"].(Number); !ok || f.String() != "1.50" {
+			t.Errorf("UseNumber f = %#v", body["f"])
+		}
+
+		var (
+			arr []interface{}
+			s   string
+		)
+		if !dec.More() {
+			t.Error("More = false, want true")
+		}
+		if err := dec.Decode(&arr); err != nil || len(arr) != 1 {
+			t.Errorf("second value = %v, %v", arr, err)
+		}
+		if err := dec.Decode(&s); err != nil || s != "s" {
+			t.Errorf("third value = %v, %v", s, err)
+		}
+
+		dec = e.NewDecoder(strings.NewReader(`{"name":"n","unknown":1}`))
+		dec.DisallowUnknownFields()
+		var item conformanceItem
+		if err := dec.Decode(&item); err == nil {
+			t.Error("DisallowUnknownFields should fail")
+		}
+	})
+}
+
+// Token与encoding/json一致, 之后可继续Decode/More
+func TestDecoderToken(t *testing.T) {
+	const in = `{"list":[{"uid":12345678901234567890},{"uid":2}],"s":"x","b":true,"z":null}`
+
+	tokens := func(dec Decoder) (out []interface{}) {
+		dec.UseNumber()
+		for {
+			tok, err := dec.Token()
+			if err == io.EOF {
+				return out
+			}
+			if err != nil {
+				return append(out, err.Error())
+			}
+			out = append(out, tok)
+		}
+	}
+	want := tokens(stdjson.NewDecoder(strings.NewReader(in)))
+
+	forEngines(t, func(t *testing.T, e Engine) {
+		if got := tokens(e.NewDecoder(strings.NewReader(in))); !reflect.DeepEqual(got, want) {
+			t.Errorf("Token() = %v, want %v", got, want)
+		}
+
+		// 流式读取数组: Token读到'[', 每个元素Decode
+		dec := e.NewDecoder(strings.NewReader(` [{"uid":12345678901234567890},{"uid":2}] `))
+		dec.UseNumber()
+		if tok, err := dec.Token(); err != nil || tok != Delim('[') {
+			t.Fatalf("Token() = %v, %v, want [", tok, err)
+		}
+
+		var uids []string
+		for dec.More() {
+			var item struct{ Uid Number }
+			if err := dec.Decode(&item); err != nil {
+				t.Fatalf("Decode error: %v", err)
+			}
+			uids = append(uids, item.Uid.String())
+		}
+		if !reflect.DeepEqual(uids, []string{"12345678901234567890", "2"}) {
+			t.Errorf("uids = %v", uids)
+		}
+		if tok, err := dec.Token(); err != nil || tok != Delim(']') {
+			t.Errorf("Token() = %v, %v, want ]", tok, err)
+		}
+
+		// 先Decode再Token, 已缓冲的输入不能丢失
+		dec = e.NewDecoder(strings.NewReader(`{"a":1} [2]`))
+		var first map[string]interface{}
+		if err := dec.Decode(&first); err != nil {
+			t.Fatalf("Decode error: %v", err)
+		}
+		if tok, err := dec.Token(); err != nil || tok != Delim('[') {
+			t.Errorf("Token() after Decode = %v, %v, want [", tok, err)
+		}
+	})
+}
+
+func TestEncoder(t *testing.T) {
+	forEngines(t, func(t *testing.T, e Engine) {
+		for _, escape := range []bool{true, false} {
+			for _, indent := range []string{"", "\t"} {
+				var want, got bytes.Buffer
+				v := map[string]interface{}{"html": "<a&b>", "list": []interface{}{1, map[string]int{"n": 2}}}
+
+				wenc := stdjson.NewEncoder(&want)
+				wenc.SetEscapeHTML(escape)
+				wenc.SetIndent("", indent)
+				wenc.Encode(v)
+				wenc.Encode(v)
+
+				enc := e.NewEncoder(&got)
+				enc.SetEscapeHTML(escape)
+				enc.SetIndent("", indent)
+				if err := enc.Encode(v); err != nil {
+					t.Fatalf("Encode error: %v", err)
+				}
+				enc.Encode(v)
+
+				if got.String() != want.String() {
+					t.Errorf("Encoder(escapeHTML=%v, indent=%q) = %q, want %q", escape, indent, got.String(), want.String())
+				}
+			}
+		}
+	})
+}
@@ -2,13 +2,139 @@
 
 package json
 
-import "github.com/json-iterator/go"
-
-var (
-	json          = jsoniter.ConfigCompatibleWithStandardLibrary
-	Marshal       = json.Marshal
-	Unmarshal     = json.Unmarshal
-	MarshalIndent = json.MarshalIndent
-	NewDecoder    = json.NewDecoder
-	NewEncoder    = json.NewEncoder
+import (
+	stdjson "encoding/json"
+	"github.com/json-iterator/go"
+	"io"
 )
+
+var iter = jsoniter.ConfigCompatibleWithStandardLibrary
+
+// 使用 -tags=jsoniter 编译时才依赖jsoniter, 注册后默认使用, 仍可用Use("std")切换
+var defaultEngine Engine = iterEngine{}
+
+func init() {
+	Register(iterEngine{})
+}
+
+type iterEngine struct{}
+
+func (iterEngine) Name() string {
+	return "jsoniter"
+}
+
+func (iterEngine) Marshal(v interface{}) ([]byte, error) {
+	return iter.Marshal(v)
+}
+
+// jsoniter的缩进只支持空格且不支持prefix, 缩进输出不在热路径上, 直接使用encoding/json
+func (iterEngine) MarshalIndent(v interface{}, prefix, indent string) ([]byte, error) {
+	return stdjson.MarshalIndent(v, prefix, indent)
+}
+
+func (iterEngine) Unmarshal(data []byte, v interface{}) error {
+	return iter.Unmarshal(data, v)
+}
+
+func (iterEngine) NewEncoder(w io.Writer) Encoder {
+	return &iterEncoder{w: w, escapeHTML: true}
+}
+
+func (iterEngine) NewDecoder(r io.Reader) Decoder {
+	return &iterDecoder{Decoder: iter.NewDecoder(r), r: r}
+}
+
+// iterEncoder 设置缩进后同MarshalIndent改用encoding/json
+type iterEncoder struct {
+	w              io.Writer
+	escapeHTML     bool
+	prefix, indent string
+}
+
+func (enc *iterEncoder) Encode(v interface{}) error {
+	if enc.prefix == "" && enc.indent == "" {
+		ie := iter.NewEncoder(enc.w)
+		ie.SetEscapeHTML(enc.escapeHTML)
+		return ie.Encode(v)
+	}
+
+	se := stdjson.NewEncoder(enc.w)
+	se.SetEscapeHTML(enc.escapeHTML)
+	se.SetIndent(enc.prefix, enc.indent)
+	return se.Encode(v)
+}
+
+func (enc *iterEncoder) SetIndent(prefix, indent string) {
+	enc.prefix, enc.indent = prefix, indent
+}
+
+func (enc *iterEncoder) SetEscapeHTML(on bool) {
+	enc.escapeHTML = on
+}
+
+// iterDecoder jsoniter没有Token, 首次调用Token后剩余的输入都改用encoding/json读取
+type iterDecoder struct {
+	*jsoniter.Decoder
+	r   io.Reader
+	std *stdjson.Decoder
+
+	useNumber, disallowUnknown bool
+}
+
+func (dec *iterDecoder) Decode(v interface{}) error {
+	if dec.std != nil {
+		return dec.std.Decode(v)
+	}
+
+	return dec.Decoder.Decode(v)
+}
+
+func (dec *iterDecoder) Token() (Token, error) {
+	if dec.std == nil {
+		dec.std = stdjson.NewDecoder(io.MultiReader(dec.Decoder.Buffered(), dec.r))
+		if dec.useNumber {
+			dec.std.UseNumber()
+		}
+		if dec.disallowUnknown {
+			dec.std.DisallowUnknownFields()
+		}
+	}
+
+	return dec.std.Token()
+}
+
+func (dec *iterDecoder) UseNumber() {
+	dec.useNumber = true
+	if dec.std != nil {
+		dec.std.UseNumber()
+		return
+	}
+
+	dec.Decoder.UseNumber()
+}
+
+func (dec *iterDecoder) DisallowUnknownFields() {
+	dec.disallowUnknown = true
+	if dec.std != nil {
+		dec.std.DisallowUnknownFields()
+		return
+	}
+
+	dec.Decoder.DisallowUnknownFields()
+}
+
+func (dec *iterDecoder) More() bool {
+	if dec.std != nil {
+		return dec.std.More()
+	}
+
+	return dec.Decoder.More()
+}
+
+func (dec *iterDecoder) Buffered() io.Reader {
+	if dec.std != nil {
+		return dec.std.Buffered()
+	}
+
+	return dec.Decoder.Buffered()
+}
@@ -0,0 +1,6 @@
+// +build !jsoniter
+
+package json
+
+// 默认使用encoding/json, 不编译jsoniter
+var defaultEngine Engine = stdEngine{}
@@ -0,0 +1,60 @@
+package mengine
+
+import "sync"
+
+// 请求级的键值存储, 用于中间件向处理函数传递数据
+type keys struct {
+	mu sync.RWMutex
+	m  map[string]interface{}
+}
+
+// Set 保存请求级数据
+func (ctx *Context) Set(key string, v interface{}) {
+	ctx.guard()
+	ctx.keys.mu.Lock()
+	if ctx.keys.m == nil {
+		ctx.keys.m = make(map[string]interface{})
+	}
+	ctx.keys.m[key] = v
+	ctx.keys.mu.Unlock()
+}
+
+// Get 读取Set保存的数据
+func (ctx *Context) Get(key string) (v interface{}, ok bool) {
+	ctx.guard()
+	ctx.keys.mu.RLock()
+	v, ok = ctx.keys.m[key]
+	ctx.keys.mu.RUnlock()
+	return
+}
+
+//
+func (ctx *Context) GetString(key string) string {
+	s, _ := Value[string](ctx, key)
+	return s
+}
+
+//
+func (ctx *Context) GetInt64(key string) int64 {
+	n, _ := Value[int64](ctx, key)
+	return n
+}
+
+//
+func (ctx *Context) GetBool(key string) bool {
+	b, _ := Value[bool](ctx, key)
+	return b
+}
+
+// Value 按类型读取Set保存的数据, 不存在或类型不符时ok为false
+//
+//	uid, ok := mengine.Value[int64](ctx, "tenant")
+func Value[T any](ctx *Context, key string) (v T, ok bool) {
+	raw, exist := ctx.Get(key)
+	if !exist {
+		return
+	}
+
+	v, ok = raw.(T)
+	return
+}
@@ -0,0 +1,47 @@
+package mengine
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestValue(t *testing.T) {
+	ctx := &Context{}
+	ctx.Set("uid", int64(7))
+	ctx.Set("int", 7)
+	ctx.Set("name", "tom")
+	ctx.Set("err", errors.New("boom"))
+	ctx.Set("nil", nil)
+
+	if v, ok := Value[int64](ctx, "uid"); !ok || v != 7 {
+		t.Errorf("Value[int64](uid) = %v, %v", v, ok)
+	}
+	if v, ok := Value[error](ctx, "err"); !ok || v.Error() != "boom" {
+		t.Errorf("Value[error](err) = %v, %v, want interface match", v, ok)
+	}
+	if v, ok := Value[interface{}](ctx, "name"); !ok || v != "tom" {
+		t.Errorf("Value[interface{}](name) = %v, %v", v, ok)
+	}
+
+	// 类型不符时返回零值, 不做数值转换
+	if v, ok := Value[int64](ctx, "int"); ok || v != 0 {
+		t.Errorf("Value[int64](int) = %v, %v, want mismatch", v, ok)
+	}
+	if v, ok := Value[int](ctx, "uid"); ok || v != 0 {
+		t.Errorf("Value[int](uid) = %v, %v, want mismatch", v, ok)
+	}
+	if v, ok := Value[fmt.Stringer](ctx, "name"); ok || v != nil {
+		t.Errorf("Value[fmt.Stringer](name) = %v, %v, want mismatch", v, ok)
+	}
+	if v, ok := Value[*Context](ctx, "nil"); ok || v != nil {
+		t.Errorf("Value[*Context](nil) = %v, %v, want mismatch", v, ok)
+	}
+	if v, ok := Value[string](ctx, "missing"); ok || v != "" {
+		t.Errorf("Value[string](missing) = %q, %v", v, ok)
+	}
+
+	if ctx.GetString("uid") != "" || ctx.GetInt64("int") != 0 || ctx.GetBool("name") || ctx.GetInt64("uid") != 7 || ctx.GetString("name") != "tom" {
+		t.Error("typed getters should return zero value on mismatch")
+	}
+}
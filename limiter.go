@@ -0,0 +1,204 @@
+package mengine
+
+import (
+	oscontext "context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+type ConcurrencyOption struct {
+	MaxInFlight  int           // 全局同时处理的请求数, 为0时不限制; 路由级见RouteConfig.MaxInFlight
+	MaxQueue     int           // 达到上限后允许排队的请求数, 超出立即拒绝
+	QueueTimeout time.Duration // 排队的最长时间, 默认1秒
+
+	// 自适应: 处理延迟超过TargetLatency(默认100毫秒)时逐步降低全局上限(不低于MinInFlight), 恢复后逐个增加
+	Adaptive      bool
+	TargetLatency time.Duration
+	MinInFlight   int
+}
+
+var (
+	errQueueFull    = errors.New("queue full")
+	errQueueTimeout = errors.New("queue timeout")
+)
+
+// ConcurrencyLimit 并发限制中间件, 超出上限且排队失败时返回CodeBusy
+func ConcurrencyLimit(option *ConcurrencyOption) Middleware {
+	opt := *option // 不修改调用方的配置
+	if opt.QueueTimeout <= 0 {
+		opt.QueueTimeout = time.Second
+	}
+	if opt.Adaptive && opt.TargetLatency <= 0 {
+		opt.TargetLatency = 100 * time.Millisecond
+	}
+
+	var global *limiter
+	if opt.MaxInFlight > 0 {
+		global = newLimiter(opt.MaxInFlight, opt.MaxQueue)
+		if opt.Adaptive {
+			global.adaptive(opt.TargetLatency, opt.MinInFlight, opt.MaxInFlight)
+		}
+	}
+
+	var routes sync.Map // path -> *limiter
+
+	return func(h HFunc) HFunc {
+		return func(ctx *Context, res map[string]interface{}) Error {
+			var lims []*limiter
+			if n := ctx.RouteConfig().MaxInFlight; n > 0 {
+				l, ok := routes.Load(ctx.Path())
+				if !ok { // 只在首次请求时创建
+					l, _ = routes.LoadOrStore(ctx.Path(), newLimiter(n, opt.MaxQueue))
+				}
+				lims = append(lims, l.(*limiter))
+			}
+			if global != nil {
+				lims = append(lims, global)
+			}
+
+			for i, l := range lims {
+				if e := l.acquire(ctx, opt.QueueTimeout); e != nil {
+					for _, acquired := range lims[:i] {
+						acquired.release(0)
+					}
+					return BusyFailure(fmt.Sprintf("concurrency limit: %v", e))
+				}
+			}
+
+			start := time.Now()
+			defer func() {
+				elapsed := time.Since(start)
+				for _, l := range lims {
+					l.release(elapsed)
+				}
+			}()
+
+			return h(ctx, res)
+		}
+	}
+}
+
+// limiter 带有界等待队列的信号量, 先进先出
+type limiter struct {
+	mu       sync.Mutex
+	limit    int
+	inflight int
+	maxQueue int
+	waiters  []chan struct{}
+
+	// adaptive
+	target   time.Duration
+	min      int
+	max      int
+	ewma     float64 // 平均延迟, 秒
+	observed int
+}
+
+func newLimiter(limit, maxQueue int) *limiter {
+	return &limiter{limit: limit, maxQueue: maxQueue}
+}
+
+func (l *limiter) adaptive(target time.Duration, min, max int) {
+	if min <= 0 {
+		min = 1
+	}
+
+	l.target = target
+	l.min = min
+	l.max = max
+}
+
+func (l *limiter) acquire(ctx oscontext.Context, timeout time.Duration) error {
+	l.mu.Lock()
+	if l.inflight < l.limit {
+		l.inflight++
+		l.mu.Unlock()
+		return nil
+	}
+
+	if len(l.waiters) >= l.maxQueue {
+		l.mu.Unlock()
+		return errQueueFull
+	}
+
+	ready := make(chan struct{})
+	l.waiters = append(l.waiters, ready)
+	l.mu.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var e error
+	select {
+	case <-ready: // release已将名额转交
+		return nil
+	case <-timer.C:
+		e = errQueueTimeout
+	case <-ctx.Done():
+		e = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i, w := range l.waiters {
+		if w == ready {
+			l.waiters = append(l.waiters[:i], l.waiters[i+1:]...)
+			return e
+		}
+	}
+
+	// 超时的同时已被唤醒, 名额已转交, 视为获取成功
+	return nil
+}
+
+// release 释放名额, elapsed用于自适应调整
+func (l *limiter) release(elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.target > 0 && elapsed > 0 {
+		l.observe(elapsed)
+	}
+
+	l.inflight--
+	l.wake()
+}
+
+// wake 在名额允许时唤醒排队的请求, 需持有锁
+func (l *limiter) wake() {
+	for len(l.waiters) > 0 && l.inflight < l.limit {
+		ready := l.waiters[0]
+		l.waiters = l.waiters[1:]
+		l.inflight++
+		close(ready)
+	}
+}
+
+// observe 延迟的指数移动平均超过目标时上限降10%, 否则每个窗口加1, 需持有锁
+func (l *limiter) observe(elapsed time.Duration) {
+	const alpha = 0.2
+
+	if l.ewma == 0 {
+		l.ewma = elapsed.Seconds()
+	} else {
+		l.ewma = alpha*elapsed.Seconds() + (1-alpha)*l.ewma
+	}
+
+	l.observed++
+	if l.observed < l.limit { // 每处理约limit个请求调整一次
+		return
+	}
+	l.observed = 0
+
+	if l.ewma > l.target.Seconds() {
+		l.limit = l.limit * 9 / 10
+		if l.limit < l.min {
+			l.limit = l.min
+		}
+	} else if l.limit < l.max {
+		l.limit++
+	}
+}
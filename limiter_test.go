@@ -0,0 +1,137 @@
+package mengine
+
+import (
+	oscontext "context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// blockingMux 路由处理函数在release关闭前不返回, 进入时发送到entered
+func blockingMux(release chan struct{}, entered chan string, routes map[string]*RouteConfig) *Mux {
+	mux := NewMux()
+	for path, cfg := range routes {
+		path := path
+		mux.Handle(path, func(c *Context, res map[string]interface{}) Error {
+			entered <- path
+			<-release
+			return nil
+		}, cfg)
+	}
+	mux.Handle("/t/fast", func(c *Context, res map[string]interface{}) Error {
+		return nil
+	}, nil)
+	return mux
+}
+
+func TestConcurrencyQueueTimeout(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan string, 1)
+	eg := newTestEngine(blockingMux(release, entered, map[string]*RouteConfig{"/t/slow": nil}))
+	eg.Use(ConcurrencyLimit(&ConcurrencyOption{MaxInFlight: 1, MaxQueue: 1, QueueTimeout: 20 * time.Millisecond}))
+
+	done := make(chan struct{})
+	go func() {
+		serve(eg, "/t/slow", "{}")
+		close(done)
+	}()
+	<-entered
+
+	start := time.Now()
+	w := serve(eg, "/t/fast", "{}")
+	if !strings.Contains(w.Body.String(), `"code":-6`) || time.Since(start) < 20*time.Millisecond {
+		t.Errorf("queued = %s after %v, want busy after queue timeout", w.Body.String(), time.Since(start))
+	}
+
+	// 排队中的请求在名额释放后执行
+	queued := make(chan string, 1)
+	go func() {
+		queued <- serve(eg, "/t/fast", "{}").Body.String()
+	}()
+	time.Sleep(5 * time.Millisecond)
+	close(release)
+	<-done
+	if body := <-queued; !strings.Contains(body, `"code":0`) {
+		t.Errorf("queued after release = %s, want success", body)
+	}
+}
+
+func TestConcurrencyQueueFull(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan string, 1)
+	defer close(release)
+	eg := newTestEngine(blockingMux(release, entered, map[string]*RouteConfig{"/t/slow": nil}))
+	eg.Use(ConcurrencyLimit(&ConcurrencyOption{MaxInFlight: 1, QueueTimeout: time.Second}))
+
+	go serve(eg, "/t/slow", "{}")
+	<-entered
+
+	start := time.Now()
+	if w := serve(eg, "/t/fast", "{}"); !strings.Contains(w.Body.String(), `"code":-6`) || time.Since(start) > 500*time.Millisecond {
+		t.Errorf("no queue = %s after %v, want busy immediately", w.Body.String(), time.Since(start))
+	}
+}
+
+// 路由级上限只限制该路由, 全局上限限制所有路由
+func TestConcurrencyRouteAndGlobal(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan string, 2)
+	defer close(release)
+	eg := newTestEngine(blockingMux(release, entered, map[string]*RouteConfig{
+		"/t/a": {MaxInFlight: 1},
+		"/t/b": nil,
+	}))
+	eg.Use(ConcurrencyLimit(&ConcurrencyOption{MaxInFlight: 2, QueueTimeout: 10 * time.Millisecond}))
+
+	go serve(eg, "/t/a", "{}")
+	<-entered
+
+	if w := serve(eg, "/t/a", "{}"); !strings.Contains(w.Body.String(), `"code":-6`) {
+		t.Errorf("second /t/a = %s, want busy by route limit", w.Body.String())
+	}
+	if w := serve(eg, "/t/fast", "{}"); !strings.Contains(w.Body.String(), `"code":0`) {
+		t.Errorf("/t/fast = %s, want allowed under global limit", w.Body.String())
+	}
+
+	go serve(eg, "/t/b", "{}")
+	<-entered
+
+	if w := serve(eg, "/t/fast", "{}"); !strings.Contains(w.Body.String(), `"code":-6`) {
+		t.Errorf("/t/fast = %s, want busy by global limit", w.Body.String())
+	}
+}
+
+// 延迟超过目标时上限逐步降到MinInFlight, 恢复后逐个增加到MaxInFlight
+func TestAdaptiveLimit(t *testing.T) {
+	l := newLimiter(10, 0)
+	l.adaptive(100*time.Millisecond, 2, 10)
+
+	run := func(elapsed time.Duration, n int) {
+		for i := 0; i < n; i++ {
+			if e := l.acquire(oscontext.Background(), time.Second); e != nil {
+				t.Fatal(e)
+			}
+			l.release(elapsed)
+		}
+	}
+
+	run(200*time.Millisecond, 10)
+	if l.limit != 9 {
+		t.Fatalf("limit after one slow window = %v, want 9", l.limit)
+	}
+
+	run(200*time.Millisecond, 100)
+	if l.limit != 2 {
+		t.Fatalf("limit after slow = %v, want min 2", l.limit)
+	}
+
+	run(time.Millisecond, 2) // ewma仍高于目标
+	if l.limit != 2 {
+		t.Fatalf("limit while ewma high = %v, want 2", l.limit)
+	}
+
+	run(time.Millisecond, 200)
+	if l.limit != 10 {
+		t.Fatalf("limit after recovery = %v, want max 10", l.limit)
+	}
+	if l.ewma > 0.1 {
+		t.Fatalf("ewma = %v, want below target", l.ewma)
+	}
+}
@@ -0,0 +1,231 @@
+package mengine
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	sizeBuckets    = []float64{128, 512, 1024, 4096, 16384, 65536, 262144, 1048576}
+)
+
+// Metrics 请求指标, 以Prometheus文本格式输出, 设置EngionOption.MetricsPath后启用
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestKey]uint64
+	routes   map[routeKey]*routeStats
+	failures map[failureKey]uint64
+}
+
+type requestKey struct {
+	route string
+	itype string
+	code  int32
+}
+
+type routeKey struct {
+	route string
+	itype string
+}
+
+type routeStats struct {
+	latency  *histogram
+	reqSize  *histogram
+	respSize *histogram
+}
+
+type failureKey struct {
+	kind   string
+	code   int
+	reason string
+}
+
+//
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]uint64),
+		routes:   make(map[routeKey]*routeStats),
+		failures: make(map[failureKey]uint64),
+	}
+}
+
+// observe 记录一次已路由的请求
+func (m *Metrics) observe(ctx *Context, code int32, respSize int) {
+	if m == nil {
+		return
+	}
+
+	path := ctx.Path()
+	rk := routeKey{route: ctx.routeName(), itype: path[1:2]}
+	elapsed := time.Since(ctx.start).Seconds()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{route: rk.route, itype: rk.itype, code: code}]++
+
+	stats, ok := m.routes[rk]
+	if !ok {
+		stats = &routeStats{
+			latency:  newHistogram(latencyBuckets),
+			reqSize:  newHistogram(sizeBuckets),
+			respSize: newHistogram(sizeBuckets),
+		}
+		m.routes[rk] = stats
+	}
+
+	stats.latency.observe(elapsed)
+	stats.reqSize.observe(float64(len(ctx.BodyRaw)))
+	stats.respSize.observe(float64(respSize))
+}
+
+// fail 记录comfail/authfail/encfail, reason见Failure.Reason
+func (m *Metrics) fail(kind string, code int, reason string) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	m.failures[failureKey{kind: kind, code: code, reason: reason}]++
+	m.mu.Unlock()
+}
+
+// serveMetrics 指标只对CheckWhiteList通过的请求开放, 与t通道一致
+func (eg *Engine) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx := eg.acquire(w, r, eg.routeConfig(r.URL.Path))
+	defer eg.release(ctx)
+
+	if eg.CheckWhiteList == nil {
+		eg.comfail(w, r, "check white handle nil", "check white handle nil")
+		return
+	}
+
+	if e := eg.CheckWhiteList(ctx); e != nil {
+		eg.authfail(w, r, "check white", fmt.Sprintf("check white error: %v", e))
+		return
+	}
+
+	eg.Metrics.ServeHTTP(w, r)
+}
+
+// ServeHTTP 输出Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(m.Export())
+}
+
+//
+func (m *Metrics) Export() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	buf.WriteString("# HELP mengine_requests_total Requests by route, itype and envelope code.\n")
+	buf.WriteString("# TYPE mengine_requests_total counter\n")
+	reqKeys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		reqKeys = append(reqKeys, k)
+	}
+	sort.Slice(reqKeys, func(i, j int) bool {
+		a, b := reqKeys[i], reqKeys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.code < b.code
+	})
+	for _, k := range reqKeys {
+		fmt.Fprintf(buf, "mengine_requests_total{route=%s,itype=%s,code=\"%d\"} %d\n",
+			quoteLabel(k.route), quoteLabel(k.itype), k.code, m.requests[k])
+	}
+
+	routeKeys := make([]routeKey, 0, len(m.routes))
+	for k := range m.routes {
+		routeKeys = append(routeKeys, k)
+	}
+	sort.Slice(routeKeys, func(i, j int) bool { return routeKeys[i].route < routeKeys[j].route })
+
+	writeHistograms(buf, "mengine_request_duration_seconds", "Handler latency in seconds.", routeKeys,
+		func(s *routeStats) *histogram { return s.latency }, m.routes)
+	writeHistograms(buf, "mengine_request_size_bytes", "Request body size in bytes.", routeKeys,
+		func(s *routeStats) *histogram { return s.reqSize }, m.routes)
+	writeHistograms(buf, "mengine_response_size_bytes", "Response body size in bytes.", routeKeys,
+		func(s *routeStats) *histogram { return s.respSize }, m.routes)
+
+	buf.WriteString("# HELP mengine_failures_total Requests rejected by comfail, authfail or encfail.\n")
+	buf.WriteString("# TYPE mengine_failures_total counter\n")
+	failKeys := make([]failureKey, 0, len(m.failures))
+	for k := range m.failures {
+		failKeys = append(failKeys, k)
+	}
+	sort.Slice(failKeys, func(i, j int) bool {
+		a, b := failKeys[i], failKeys[j]
+		if a.kind != b.kind {
+			return a.kind < b.kind
+		}
+		return a.reason < b.reason
+	})
+	for _, k := range failKeys {
+		fmt.Fprintf(buf, "mengine_failures_total{kind=%s,code=\"%d\",reason=%s} %d\n",
+			quoteLabel(k.kind), k.code, quoteLabel(k.reason), m.failures[k])
+	}
+
+	return buf.Bytes()
+}
+
+func writeHistograms(buf *bytes.Buffer, name, help string, keys []routeKey,
+	get func(s *routeStats) *histogram, routes map[routeKey]*routeStats) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for _, k := range keys {
+		labels := "route=" + quoteLabel(k.route) + ",itype=" + quoteLabel(k.itype)
+		h := get(routes[k])
+
+		cumulative := uint64(0)
+		for i, le := range h.bounds {
+			cumulative += h.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(le), cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", name, labels, h.count)
+	}
+}
+
+// histogram 非累计计数, 输出时再累加
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	i := sort.SearchFloat64s(h.bounds, v)
+	if i < len(h.bounds) {
+		h.counts[i]++
+	}
+
+	h.sum += v
+	h.count++
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(v string) string {
+	return `"` + labelEscaper.Replace(v) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
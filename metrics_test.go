@@ -0,0 +1,122 @@
+package mengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// prefixRouter 按前缀匹配的Router, 模拟带路径参数的路由
+type prefixRouter struct {
+	prefix string
+	h      HFunc
+	cfg    *RouteConfig
+}
+
+func (pr *prefixRouter) Rout(path string) (HFunc, bool) {
+	return pr.h, strings.HasPrefix(path, pr.prefix)
+}
+
+func (pr *prefixRouter) Config(path string) *RouteConfig {
+	return pr.cfg
+}
+
+func scrape(t *testing.T, eg *Engine) string {
+	w := httptest.NewRecorder()
+	eg.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics status = %v", w.Code)
+	}
+	return w.Body.String()
+}
+
+func TestMetricsExposition(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/named", func(c *Context, res map[string]interface{}) Error {
+		return nil
+	}, &RouteConfig{Name: "we\"ird\\name\n"})
+	mux.Handle("/t/path", func(c *Context, res map[string]interface{}) Error {
+		return nil
+	}, nil)
+
+	eg := newTestEngine(mux)
+	eg.MetricsPath = "/metrics"
+	eg.Metrics = NewMetrics()
+
+	for i := 0; i < 3; i++ {
+		serve(eg, "/t/named", "{}")
+	}
+	serve(eg, "/t/path", `{"pad":"`+strings.Repeat("x", 590)+`"}`)
+
+	out := scrape(t, eg)
+	for _, want := range []string{
+		`mengine_requests_total{route="we\"ird\\name\n",itype="t",code="0"} 3`,
+		`mengine_requests_total{route="/t/path",itype="t",code="0"} 1`,
+		`mengine_request_size_bytes_bucket{route="/t/path",itype="t",le="512"} 0`,
+		`mengine_request_size_bytes_bucket{route="/t/path",itype="t",le="1024"} 1`,
+		`mengine_request_size_bytes_sum{route="/t/path",itype="t"} 600`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+
+	// 每组bucket累计不减, +Inf与_count一致
+	last := map[string]uint64{}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "#") || line == "" {
+			continue
+		}
+
+		sp := strings.LastIndexByte(line, ' ')
+		n, e := strconv.ParseFloat(line[sp+1:], 64)
+		if e != nil {
+			t.Fatalf("invalid sample %q", line)
+		}
+
+		name := line[:strings.IndexByte(line, '{')]
+		labels := line[len(name):sp]
+		switch {
+		case strings.HasSuffix(name, "_bucket"):
+			series := strings.TrimSuffix(name, "_bucket") + labels[:strings.Index(labels, ",le=")]
+			if uint64(n) < last[series] {
+				t.Errorf("bucket not cumulative: %s", line)
+			}
+			last[series] = uint64(n)
+			if strings.Contains(labels, `le="+Inf"`) {
+				last[series+" inf"] = uint64(n)
+			}
+		case strings.HasSuffix(name, "_count"):
+			series := strings.TrimSuffix(name, "_count") + strings.TrimSuffix(labels, "}")
+			if inf, ok := last[series+" inf"]; !ok || inf != uint64(n) {
+				t.Errorf("%s: +Inf bucket %v, count %v", series, inf, n)
+			}
+		}
+	}
+}
+
+// 没有路由名的自定义Router不按URL产生序列
+func TestMetricsRouteLabel(t *testing.T) {
+	eg := newTestEngine(nil)
+	eg.Router = &prefixRouter{prefix: "/t/user/", h: func(c *Context, res map[string]interface{}) Error {
+		return nil
+	}, cfg: &RouteConfig{}}
+	eg.MetricsPath = "/metrics"
+	eg.Metrics = NewMetrics()
+
+	serve(eg, "/t/user/1", "{}")
+	serve(eg, "/t/user/2", "{}")
+
+	out := scrape(t, eg)
+	if strings.Contains(out, "/t/user/") || !strings.Contains(out, `mengine_requests_total{route="unnamed",itype="t",code="0"} 2`) {
+		t.Errorf("metrics = %s, want one unnamed series", out)
+	}
+
+	eg.Router.(*prefixRouter).cfg = &RouteConfig{Name: "user"}
+	serve(eg, "/t/user/3", "{}")
+	if out = scrape(t, eg); !strings.Contains(out, `mengine_requests_total{route="user",itype="t",code="0"} 1`) {
+		t.Errorf("metrics = %s, want named series", out)
+	}
+}
@@ -0,0 +1,123 @@
+package mengine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ClientCertPolicy 各通道对客户端证书的要求
+type ClientCertPolicy int
+
+const (
+	ClientCertNone    ClientCertPolicy = iota // 不要求
+	ClientCertRequest                         // 客户端提供时校验
+	ClientCertRequire                         // 必须提供并通过校验
+)
+
+// MTLSOption 双向TLS配置, RunTLS时生效
+type MTLSOption struct {
+	CAFiles []string                  // 客户端CA证书文件(PEM)
+	CAPool  *x509.CertPool            // 与CAFiles合并
+	Policy  map[byte]ClientCertPolicy // itype('t'/'i'/'x') -> 证书要求
+}
+
+// clientCAs 合并CAFiles和CAPool
+func (opt *MTLSOption) clientCAs() (*x509.CertPool, error) {
+	pool := opt.CAPool
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+
+	for _, file := range opt.CAFiles {
+		pem, e := ioutil.ReadFile(file)
+		if e != nil {
+			return nil, e
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %v", file)
+		}
+	}
+
+	return pool, nil
+}
+
+// tlsConfig 握手阶段还不知道itype, 只要有通道需要证书就请求并校验,
+// 是否必须提供在ServeHTTP中按itype检查
+func (eg *Engine) tlsConfig() (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	if eg.MTLS == nil {
+		return cfg, nil
+	}
+
+	pool, e := eg.MTLS.clientCAs()
+	if e != nil {
+		return nil, e
+	}
+
+	cfg.ClientCAs = pool
+	for _, policy := range eg.MTLS.Policy {
+		if policy != ClientCertNone {
+			cfg.ClientAuth = tls.VerifyClientCertIfGiven
+		}
+	}
+
+	return cfg, nil
+}
+
+// checkClientCert 按itype检查是否已提供校验通过的客户端证书
+func (eg *Engine) checkClientCert(itype byte, r *http.Request) error {
+	if eg.MTLS == nil || eg.MTLS.Policy[itype] != ClientCertRequire {
+		return nil
+	}
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) <= 0 {
+		return errors.New("client certificate required")
+	}
+
+	return nil
+}
+
+// PeerCert 校验通过的客户端证书, 未提供时返回nil
+func (ctx *Context) PeerCert() *x509.Certificate {
+	r := ctx.Request
+	if r.TLS == nil || len(r.TLS.VerifiedChains) <= 0 || len(r.TLS.VerifiedChains[0]) <= 0 {
+		return nil
+	}
+
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// CertSubject 客户端证书的Subject, 如"CN=order-svc,O=example"
+func (ctx *Context) CertSubject() string {
+	cert := ctx.PeerCert()
+	if cert == nil {
+		return ""
+	}
+
+	return cert.Subject.String()
+}
+
+// CertSANs 客户端证书的SAN, 包括DNS、IP、URI和Email
+func (ctx *Context) CertSANs() []string {
+	cert := ctx.PeerCert()
+	if cert == nil {
+		return nil
+	}
+
+	sans := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses)+len(cert.URIs)+len(cert.EmailAddresses))
+	sans = append(sans, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	sans = append(sans, cert.EmailAddresses...)
+
+	return sans
+}
@@ -0,0 +1,117 @@
+package mengine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMTLSConfig(t *testing.T) {
+	eg := newTestEngine(NewMux())
+	if cfg, e := eg.tlsConfig(); e != nil || cfg.ClientAuth != tls.NoClientCert {
+		t.Fatalf("without MTLS = %v, %v", cfg.ClientAuth, e)
+	}
+
+	dir := t.TempDir()
+	caFile, _ := newTestCert(t, "ca", nil).write(t, dir, "ca")
+	eg.MTLS = &MTLSOption{CAFiles: []string{caFile}, Policy: map[byte]ClientCertPolicy{'t': ClientCertNone}}
+	if cfg, e := eg.tlsConfig(); e != nil || cfg.ClientAuth != tls.NoClientCert || cfg.ClientCAs == nil {
+		t.Fatalf("policy none = %v, %v", cfg.ClientAuth, e)
+	}
+
+	// 只要有通道需要证书, 握手阶段就请求并校验
+	eg.MTLS.Policy['x'] = ClientCertRequire
+	if cfg, e := eg.tlsConfig(); e != nil || cfg.ClientAuth != tls.VerifyClientCertIfGiven {
+		t.Fatalf("policy require = %v, %v", cfg.ClientAuth, e)
+	}
+
+	empty := filepath.Join(dir, "empty.pem")
+	ioutil.WriteFile(empty, []byte("no pem here"), 0600)
+	for _, files := range [][]string{{empty}, {filepath.Join(dir, "missing.pem")}} {
+		eg.MTLS.CAFiles = files
+		if _, e := eg.tlsConfig(); e == nil {
+			t.Errorf("CAFiles %v should fail", files)
+		}
+	}
+}
+
+// 各通道按策略要求证书, 不受信任的证书在握手阶段被拒绝
+func TestMTLSPolicy(t *testing.T) {
+	ca := newTestCert(t, "ca", nil)
+	server := newTestCert(t, "127.0.0.1", ca)
+	client := newTestCert(t, "order-svc", ca)
+	stranger := newTestCert(t, "stranger", newTestCert(t, "other-ca", nil))
+
+	mux := NewMux()
+	h := func(c *Context, res map[string]interface{}) Error {
+		res["subject"] = c.CertSubject()
+		res["sans"] = c.CertSANs()
+		return nil
+	}
+	mux.Handle("/t/who", h, nil)
+	mux.Handle("/i/who", h, nil)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	eg := newTestEngine(mux)
+	eg.MTLS = &MTLSOption{CAPool: pool, Policy: map[byte]ClientCertPolicy{
+		't': ClientCertRequire,
+		'i': ClientCertRequest,
+	}}
+
+	cfg, e := eg.tlsConfig()
+	if e != nil {
+		t.Fatal(e)
+	}
+	cfg.Certificates = []tls.Certificate{server.tls()}
+
+	ts := httptest.NewUnstartedServer(eg)
+	ts.TLS = cfg
+	ts.StartTLS()
+	defer ts.Close()
+
+	post := func(path string, cert *testCert) (string, error) {
+		tc := &tls.Config{RootCAs: pool}
+		if cert != nil { // 不按服务端的CA列表挑选, 总是发送
+			pair := cert.tls()
+			tc.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) { return &pair, nil }
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tc}}
+
+		resp, e := client.Post(ts.URL+path, "application/json", strings.NewReader("{}"))
+		if e != nil {
+			return "", e
+		}
+		defer resp.Body.Close()
+
+		bts, _ := ioutil.ReadAll(resp.Body)
+		return string(bts), nil
+	}
+
+	cases := []struct {
+		path string
+		cert *testCert
+		want string
+	}{
+		{"/t/who", client, `"subject":"CN=order-svc"`},
+		{"/t/who", nil, `"code":-2`},
+		{"/i/who", client, `"sans":["order-svc","127.0.0.1"]`},
+		{"/i/who", nil, `"subject":""`},
+	}
+	for _, c := range cases {
+		body, e := post(c.path, c.cert)
+		if e != nil || !strings.Contains(body, c.want) {
+			t.Errorf("%v with cert %v = %s, %v, want %s", c.path, c.cert != nil, body, e, c.want)
+		}
+	}
+
+	if _, e = post("/i/who", stranger); e == nil {
+		t.Error("untrusted client certificate accepted")
+	}
+}
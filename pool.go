@@ -0,0 +1,175 @@
+package mengine
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// 超过该大小的body缓冲不放回池中, 避免偶发的大请求长期占用内存
+const maxPooledBuffer = 1 << 20
+
+var (
+	bufferPool = sync.Pool{New: func() interface{} { return &bytes.Buffer{} }}
+	resultPool = sync.Pool{New: func() interface{} { return make(map[string]interface{}) }}
+)
+
+// acquire 创建请求的Context, 处理结束后必须调用release.
+// Context本身不池化: 它实现了context.Context, 可能被goroutine或第三方库持有, 复用会让持有方读到其他请求的数据
+func (eg *Engine) acquire(w http.ResponseWriter, r *http.Request, rc *RouteConfig) *Context {
+	return &Context{
+		Request: r,
+		eg:      eg,
+		writer:  w,
+		route:   rc,
+		start:   time.Now(),
+		codec:   requestCodec(r),
+	}
+}
+
+// release 归还池化的body缓冲, 之后对Context的方法调用由guard记录; 处理函数超时仍在运行时不归还.
+// Request保留, 返回后持有的Context作为context.Context仍可用(已随请求结束被取消), 写响应被丢弃
+func (eg *Engine) release(ctx *Context) {
+	if ctx.detached {
+		return
+	}
+
+	atomic.StoreInt32(&ctx.released, 1)
+
+	if ctx.buf != nil {
+		if ctx.buf.Cap() <= maxPooledBuffer {
+			ctx.buf.Reset()
+			bufferPool.Put(ctx.buf)
+		}
+		ctx.buf = nil
+	}
+
+	ctx.Body = nil
+	ctx.BodyRaw = nil
+	ctx.writer = releasedWriter
+}
+
+// readbody 读取(并解压)body到池化的缓冲中, 解析到ctx.Body
+func (eg *Engine) readbody(ctx *Context) error {
+	buf := bufferPool.Get().(*bytes.Buffer)
+	ctx.buf = buf
+
+	if e := eg.inflate(buf, ctx.Request.Body, ctx.Request.Header.Get("Content-Encoding")); e != nil {
+		return e
+	}
+
+	ctx.BodyRaw = buf.Bytes()
+	return ctx.parseLater()
+}
+
+// parseLater Stream路由推迟到首次使用Body时解析
+func (ctx *Context) parseLater() error {
+	if ctx.RouteConfig().Stream {
+		ctx.body = bodyRaw
+		return nil
+	}
+
+	return ctx.parseBody()
+}
+
+// parseBody 按请求的Content-Type解析BodyRaw到ctx.Body
+func (ctx *Context) parseBody() error {
+	if ctx.Body == nil {
+		ctx.Body = make(map[string]interface{})
+	}
+
+	if len(ctx.BodyRaw) <= 0 { // len <= 0, no need unmarshal
+		return nil
+	}
+
+	return ctx.bodyCodec().Unmarshal(ctx.BodyRaw, ctx.Body)
+}
+
+// bodyCodec 请求body的编解码, 未经acquire创建的Context为json
+func (ctx *Context) bodyCodec() Codec {
+	if ctx.codec == nil {
+		return defCodec
+	}
+
+	return ctx.codec
+}
+
+func acquireResult() map[string]interface{} {
+	return resultPool.Get().(map[string]interface{})
+}
+
+func releaseResult(res map[string]interface{}) {
+	for k := range res {
+		delete(res, k)
+	}
+
+	resultPool.Put(res)
+}
+
+// Copy 复制一份可在处理函数返回后继续使用的Context, 不能再写响应: SetCookie/ResponseHeader等只作用于副本自己的header
+func (ctx *Context) Copy() *Context {
+	ctx.guard()
+	ctx.materialize() // Stream路由先读取body, 流已被读取时副本没有Body
+
+	cp := &Context{
+		Body:    make(map[string]interface{}, len(ctx.Body)),
+		BodyRaw: append([]byte(nil), ctx.BodyRaw...),
+		Request: ctx.Request,
+		Uid:     ctx.Uid,
+		Claims:  ctx.Claims,
+		writer:  &discardWriter{h: make(http.Header)},
+		eg:      ctx.eg,
+		route:   ctx.route,
+		start:   ctx.start,
+		codec:   ctx.codec,
+		body:    ctx.body,
+	}
+
+	for k, v := range ctx.Body {
+		cp.Body[k] = v
+	}
+
+	ctx.keys.mu.RLock()
+	for k, v := range ctx.keys.m {
+		cp.Set(k, v)
+	}
+	ctx.keys.mu.RUnlock()
+
+	return cp
+}
+
+// discardWriter 副本或已释放的Context的writer, 写入返回错误
+type discardWriter struct {
+	h http.Header
+}
+
+// releasedWriter 各个已释放的Context共用, 每次返回新的header
+var releasedWriter = &discardWriter{}
+
+func (dw *discardWriter) Header() http.Header {
+	if dw.h == nil {
+		return make(http.Header)
+	}
+	return dw.h
+}
+
+func (dw *discardWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("context copy can not write response")
+}
+
+func (dw *discardWriter) WriteHeader(code int) {}
+
+// guard 发现处理函数返回后仍在使用Context, 只记录日志: 可能发生在处理函数启动的goroutine中, panic无法恢复.
+// 只能发现方法调用, 直接访问Body/BodyRaw等字段无法发现
+func (ctx *Context) guard() {
+	if atomic.LoadInt32(&ctx.released) == 0 {
+		return
+	}
+
+	if eg := ctx.eg; eg != nil {
+		eg.Error().Str("status", "fail").Msg("context used after handler returned, use Copy to retain it")
+	}
+}
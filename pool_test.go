@@ -0,0 +1,105 @@
+package mengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const benchBody = `{"uid":10001,"name":"mengine","tags":["a","b"],"page":{"size":20,"offset":40}}`
+
+func benchmarkServeHTTP(b *testing.B, path string) {
+	mux := NewMux()
+	mux.Handle(path, func(c *Context, res map[string]interface{}) Error {
+		res["uid"] = c.Body["uid"]
+		res["name"] = c.Body["name"]
+		return nil
+	}, nil)
+	eg := newTestEngine(mux)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, path, strings.NewReader(benchBody))
+		r.Header.Set("Content-Type", "application/json")
+		eg.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			b.Fatalf("status = %v", w.Code)
+		}
+	}
+}
+
+func BenchmarkServeHTTPTrust(b *testing.B) {
+	benchmarkServeHTTP(b, "/t/bench")
+}
+
+func BenchmarkServeHTTPIntegrity(b *testing.B) {
+	benchmarkServeHTTP(b, "/i/bench")
+}
+
+func BenchmarkServeHTTPEncrypt(b *testing.B) {
+	benchmarkServeHTTP(b, "/x/bench")
+}
+
+// 处理函数返回后Body/BodyRaw不再指向池化的数据
+func TestReleaseDropsBody(t *testing.T) {
+	var ctx *Context
+	mux := NewMux()
+	mux.Handle("/t/keep", func(c *Context, res map[string]interface{}) Error {
+		ctx = c
+		return nil
+	}, nil)
+
+	serve(newTestEngine(mux), "/t/keep", benchBody)
+	if ctx.Body != nil || ctx.BodyRaw != nil {
+		t.Fatalf("released context keeps Body=%v BodyRaw=%q", ctx.Body, ctx.BodyRaw)
+	}
+}
+
+// 处理函数返回后持有的Context作为context.Context仍可用, 不会读到后续请求的数据
+func TestRetainedContext(t *testing.T) {
+	retained := make(chan *Context, 2)
+	mux := NewMux()
+	mux.Handle("/t/keep", func(c *Context, res map[string]interface{}) Error {
+		c.Set("req", c.GetParam("n"))
+		retained <- c
+		return nil
+	}, nil)
+
+	srv := httptest.NewServer(newTestEngine(mux))
+	defer srv.Close()
+
+	for _, n := range []string{"1", "2"} {
+		resp, e := http.Post(srv.URL+"/t/keep?n="+n, "application/json", strings.NewReader("{}"))
+		if e != nil {
+			t.Fatal(e)
+		}
+		resp.Body.Close()
+	}
+
+	first, second := <-retained, <-retained
+	if first == second {
+		t.Fatal("context reused across requests")
+	}
+
+	select {
+	case <-first.Done():
+	case <-time.After(time.Second):
+		t.Fatal("retained context not done after request finished")
+	}
+	if first.Err() == nil {
+		t.Error("retained context Err() = nil")
+	}
+	if _, ok := first.Deadline(); ok {
+		t.Error("retained context has deadline")
+	}
+	if v := first.Value("req"); v != "1" {
+		t.Errorf("retained Value(req) = %v, want 1", v)
+	}
+
+	first.SetCookie(&http.Cookie{Name: "late", Value: "1"}) // 写响应被丢弃
+	first.ResponseHeader().Set("X-Late", "1")
+}
@@ -0,0 +1,79 @@
+package mengine
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// clientIP 从右向左遍历转发链, 跳过可信代理, 返回第一个不可信的地址;
+// 在此之前遇到无法解析或unknown的地址时返回nil, 不能把可信代理自身当作客户端
+// 转发头优先级: Forwarded > X-Forwarded-For > X-Real-IP
+func (eg *Engine) clientIP(r *http.Request) net.IP {
+	peer := remoteIP(r.RemoteAddr)
+	if peer == nil || !eg.proxies.Contains(peer) {
+		return peer
+	}
+
+	hops := forwardedFor(r.Header)
+	if len(hops) <= 0 {
+		if ip := remoteIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip
+		}
+		return peer
+	}
+
+	var ip net.IP
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := remoteIP(hops[i])
+		if hop == nil { // 无法解析的地址不能再继续信任, 也无法确定客户端
+			return nil
+		}
+
+		ip = hop
+		if !eg.proxies.Contains(hop) {
+			return ip
+		}
+	}
+
+	return ip // 整条链都是可信代理
+}
+
+// forwardedFor 转发链上的地址, 从左(客户端)到右(最近的代理)
+func forwardedFor(h http.Header) []string {
+	if values := h.Values("Forwarded"); len(values) > 0 {
+		return parseForwarded(values)
+	}
+
+	var hops []string
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(value, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	return hops
+}
+
+// parseForwarded 解析RFC 7239的for参数, 如 for=192.0.2.60;proto=http, for="[2001:db8::17]:4711"
+func parseForwarded(values []string) []string {
+	var hops []string
+	for _, value := range values {
+		for _, elem := range strings.Split(value, ",") {
+			hop := ""
+			for _, pair := range strings.Split(elem, ";") {
+				kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+				if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+					hop = strings.Trim(kv[1], "\"")
+				}
+			}
+
+			// 没有for或为unknown/混淆标识时保留占位, 遍历到此处即停止
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
@@ -0,0 +1,82 @@
+package mengine
+
+import (
+	"github.com/wxiaowar/mlog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	eg := NewEngine(&EngionOption{TrustedProxies: []string{"10.0.0.0/8", "fd00::/8"}}, &mlog.MLog{}, NewMux())
+
+	cases := []struct {
+		name   string
+		remote string
+		header map[string]string
+		want   string
+	}{
+		{"untrusted peer ignores headers", "1.1.1.1:80", map[string]string{"X-Forwarded-For": "2.2.2.2"}, "1.1.1.1"},
+		{"untrusted ipv6 peer", "[2001:db8::1]:443", nil, "2001:db8::1"},
+		{"trusted peer without headers", "10.0.0.5:41234", nil, "10.0.0.5"},
+		{"x-real-ip", "10.0.0.5:41234", map[string]string{"X-Real-IP": "5.5.5.5"}, "5.5.5.5"},
+		{"x-forwarded-for", "10.0.0.5:41234", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "1.2.3.4"},
+		{"skip trusted hops", "10.0.0.5:41234", map[string]string{"X-Forwarded-For": "9.9.9.9, 1.2.3.4, 10.0.0.7"}, "1.2.3.4"},
+		{"unparseable hop", "10.0.0.5:41234", map[string]string{"X-Forwarded-For": "1.2.3.4, garbage"}, ""},
+		{"only trusted proxies", "10.0.0.5:41234", map[string]string{"X-Forwarded-For": "10.0.0.8, 10.0.0.7"}, "10.0.0.8"},
+		{"forwarded ipv6 with port", "10.0.0.5:41234", map[string]string{"Forwarded": `for="[2001:db8::17]:4711"`}, "2001:db8::17"},
+		{"forwarded over x-forwarded-for", "10.0.0.5:41234", map[string]string{"Forwarded": "for=3.3.3.3", "X-Forwarded-For": "4.4.4.4"}, "3.3.3.3"},
+		{"forwarded unknown", "10.0.0.5:41234", map[string]string{"Forwarded": "for=unknown"}, ""},
+		{"trusted ipv6 peer", "[fd00::1]:80", map[string]string{"X-Forwarded-For": "2001:db8::2"}, "2001:db8::2"},
+	}
+
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodGet, "/t/ip", nil)
+		r.RemoteAddr = c.remote
+		for k, v := range c.header {
+			r.Header.Set(k, v)
+		}
+
+		ctx := &Context{Request: r, eg: eg}
+		if got := ctx.IP(); got != c.want {
+			t.Errorf("%v: IP() = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestForwardedFor(t *testing.T) {
+	cases := []struct {
+		header http.Header
+		want   []string
+	}{
+		{http.Header{}, nil},
+		{http.Header{"X-Forwarded-For": {"1.1.1.1 , 2.2.2.2", "3.3.3.3,,"}}, []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}},
+		{http.Header{"Forwarded": {"for=1.1.1.1"}, "X-Forwarded-For": {"2.2.2.2"}}, []string{"1.1.1.1"}},
+	}
+
+	for _, c := range cases {
+		if got := forwardedFor(c.header); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("forwardedFor(%v) = %q, want %q", c.header, got, c.want)
+		}
+	}
+}
+
+func TestParseForwarded(t *testing.T) {
+	cases := []struct {
+		values []string
+		want   []string
+	}{
+		{[]string{"for=192.0.2.60;proto=http;by=203.0.113.43"}, []string{"192.0.2.60"}},
+		{[]string{`For="[2001:db8:cafe::17]:4711"`}, []string{"[2001:db8:cafe::17]:4711"}},
+		{[]string{`for="_gazonk"`}, []string{"_gazonk"}},
+		{[]string{"for=192.0.2.43, for=198.51.100.17", "proto=https"}, []string{"192.0.2.43", "198.51.100.17", ""}},
+		{[]string{" proto=http ; for = 1.1.1.1"}, []string{""}},
+	}
+
+	for _, c := range cases {
+		if got := parseForwarded(c.values); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseForwarded(%q) = %q, want %q", c.values, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package mengine
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateAlgorithm 限流算法
+type RateAlgorithm int
+
+const (
+	TokenBucket   RateAlgorithm = iota // 令牌桶, 允许Burst大小的突发
+	SlidingWindow                      // 滑动窗口, 按前后两个固定窗口加权计数
+)
+
+// Quota 每Window最多Limit次
+type Quota struct {
+	Limit     int
+	Window    time.Duration
+	Burst     int // 令牌桶容量, 默认等于Limit
+	Algorithm RateAlgorithm
+}
+
+// RateResult 一次限流判断的结果
+type RateResult struct {
+	Allowed    bool
+	Remaining  int
+	RetryAfter time.Duration // 被拒绝时需要等待的时间
+	Reset      time.Duration // 配额完全恢复的时间
+}
+
+// RateStore 限流状态存储, 多实例部署时可用共享存储实现
+type RateStore interface {
+	Take(key string, q Quota, now time.Time) (RateResult, error)
+}
+
+// 常用的限流key, RateKeyUid对未登录的请求、RateKeyIP对无法确定IP的请求不限流, 需要时可与RateKeyIP各用一个中间件
+var (
+	RateKeyIP    = func(ctx *Context) string { return ctx.IP() }
+	RateKeyUid   = func(ctx *Context) string { return uidKey(ctx.Uid) }
+	RateKeyToken = func(ctx *Context) string { return ctx.Token() }
+)
+
+func uidKey(uid int64) string {
+	if uid == 0 { // 未登录的请求不能共用一个桶
+		return ""
+	}
+
+	return strconv.FormatInt(uid, 10)
+}
+
+type RateLimitOption struct {
+	Name    string                    // 用于RouteConfig.RateLimits按名字覆盖配额, 多个限流中间件时区分
+	Store   RateStore                 // 默认NewMemoryRateStore()
+	Key     func(ctx *Context) string // 默认RateKeyIP, 返回空时不限流
+	Default *Quota                    // 没有路由级配额时使用, 为nil时只限制配置了配额的路由
+}
+
+// RateLimit 限流中间件, 按路由和key分别计数, 设置X-RateLimit-*头, 超限时返回CodeRateLimit和Retry-After
+func RateLimit(option *RateLimitOption) Middleware {
+	opt := *option // 不修改调用方的配置
+	if opt.Store == nil {
+		opt.Store = NewMemoryRateStore()
+	}
+	if opt.Key == nil {
+		opt.Key = RateKeyIP
+	}
+
+	return func(h HFunc) HFunc {
+		return func(ctx *Context, res map[string]interface{}) Error {
+			q, ok := ctx.RouteConfig().RateLimits[opt.Name]
+			if !ok {
+				if opt.Default == nil {
+					return h(ctx, res)
+				}
+				q = *opt.Default
+			}
+
+			key := opt.Key(ctx)
+			if key == "" {
+				return h(ctx, res)
+			}
+
+			rr, e := opt.Store.Take(opt.Name+"|"+ctx.Path()+"|"+key, q, time.Now())
+			if e != nil { // 存储故障时放行, 不影响业务
+				ctx.eg.Error().Str("status", "fail").Str("detail", e.Error()).Msg("rate limit store error")
+				return h(ctx, res)
+			}
+
+			header := ctx.ResponseHeader()
+			header.Set("X-RateLimit-Limit", strconv.Itoa(q.Limit))
+			header.Set("X-RateLimit-Remaining", strconv.Itoa(rr.Remaining))
+			header.Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(rr.Reset)))
+
+			if !rr.Allowed {
+				header.Set("Retry-After", strconv.Itoa(ceilSeconds(rr.RetryAfter)))
+				return RateLimitFailure(fmt.Sprintf("rate limit exceeded: %v", key))
+			}
+
+			return h(ctx, res)
+		}
+	}
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// MemoryRateStore 进程内的限流存储, 长时间未访问的key会被清理
+type MemoryRateStore struct {
+	mu      sync.Mutex
+	buckets map[string]*rateBucket
+	windows map[string]*rateWindow
+	sweep   time.Time
+}
+
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+	idle   time.Duration // 超过该时间未访问即已回满, 可以清理
+}
+
+type rateWindow struct {
+	start  time.Time // 当前固定窗口的起点
+	cur    int
+	prev   int
+	window time.Duration
+}
+
+//
+func NewMemoryRateStore() *MemoryRateStore {
+	return &MemoryRateStore{
+		buckets: make(map[string]*rateBucket),
+		windows: make(map[string]*rateWindow),
+	}
+}
+
+func (ms *MemoryRateStore) Take(key string, q Quota, now time.Time) (RateResult, error) {
+	if q.Limit <= 0 || q.Window <= 0 {
+		return RateResult{}, fmt.Errorf("invalid quota %+v", q)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	ms.gc(now)
+
+	if q.Algorithm == SlidingWindow {
+		return ms.slidingWindow(key, q, now), nil
+	}
+
+	return ms.tokenBucket(key, q, now), nil
+}
+
+func (ms *MemoryRateStore) tokenBucket(key string, q Quota, now time.Time) RateResult {
+	burst := q.Burst
+	if burst <= 0 {
+		burst = q.Limit
+	}
+	rate := float64(q.Limit) / q.Window.Seconds() // 每秒补充的令牌
+
+	b, ok := ms.buckets[key]
+	if !ok {
+		b = &rateBucket{
+			tokens: float64(burst),
+			last:   now,
+			idle:   time.Duration(float64(burst) / rate * float64(time.Second)),
+		}
+		ms.buckets[key] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * rate
+	if b.tokens > float64(burst) {
+		b.tokens = float64(burst)
+	}
+	b.last = now
+
+	rr := RateResult{}
+	if b.tokens >= 1 {
+		b.tokens--
+		rr.Allowed = true
+	} else {
+		rr.RetryAfter = time.Duration((1 - b.tokens) / rate * float64(time.Second))
+	}
+
+	rr.Remaining = int(b.tokens)
+	rr.Reset = time.Duration((float64(burst) - b.tokens) / rate * float64(time.Second))
+	return rr
+}
+
+func (ms *MemoryRateStore) slidingWindow(key string, q Quota, now time.Time) RateResult {
+	start := now.Truncate(q.Window)
+
+	w, ok := ms.windows[key]
+	if !ok {
+		w = &rateWindow{start: start, window: q.Window}
+		ms.windows[key] = w
+	}
+
+	switch elapsed := start.Sub(w.start); {
+	case elapsed >= 2*q.Window:
+		w.prev, w.cur = 0, 0
+	case elapsed >= q.Window:
+		w.prev, w.cur = w.cur, 0
+	}
+	w.start = start
+
+	// 前一个窗口按未过去的比例计入
+	weight := 1 - float64(now.Sub(start))/float64(q.Window)
+	count := float64(w.prev)*weight + float64(w.cur)
+
+	rr := RateResult{Reset: start.Add(q.Window).Sub(now)}
+	if count+1 <= float64(q.Limit) {
+		w.cur++
+		count++
+		rr.Allowed = true
+	} else {
+		rr.RetryAfter = rr.Reset
+	}
+
+	rr.Remaining = q.Limit - int(count+0.999)
+	if rr.Remaining < 0 {
+		rr.Remaining = 0
+	}
+
+	return rr
+}
+
+// gc 每隔一段时间清理已完全恢复的key, 需持有锁
+func (ms *MemoryRateStore) gc(now time.Time) {
+	if now.Sub(ms.sweep) < time.Minute {
+		return
+	}
+	ms.sweep = now
+
+	for key, b := range ms.buckets {
+		if now.Sub(b.last) > b.idle {
+			delete(ms.buckets, key)
+		}
+	}
+
+	for key, w := range ms.windows {
+		if now.Sub(w.start) > 2*w.window {
+			delete(ms.windows, key)
+		}
+	}
+}
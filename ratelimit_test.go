@@ -0,0 +1,135 @@
+package mengine
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	ms := NewMemoryRateStore()
+	q := Quota{Limit: 2, Window: time.Second, Burst: 4}
+	now := time.Unix(1000, 0)
+
+	for i := 3; i >= 0; i-- { // 突发Burst次
+		if rr, _ := ms.Take("k", q, now); !rr.Allowed || rr.Remaining != i {
+			t.Fatalf("burst take = %+v, want allowed remaining %v", rr, i)
+		}
+	}
+
+	rr, _ := ms.Take("k", q, now)
+	if rr.Allowed || rr.RetryAfter != 500*time.Millisecond || rr.Reset != 2*time.Second {
+		t.Fatalf("empty bucket = %+v, want retry 500ms reset 2s", rr)
+	}
+
+	if rr, _ = ms.Take("k", q, now.Add(500*time.Millisecond)); !rr.Allowed || rr.Remaining != 0 {
+		t.Fatalf("after refill = %+v, want one token", rr)
+	}
+
+	if rr, _ = ms.Take("k", q, now.Add(time.Hour)); !rr.Allowed || rr.Remaining != 3 {
+		t.Fatalf("after idle = %+v, want capped at burst", rr)
+	}
+
+	if rr, _ = ms.Take("other", Quota{Limit: 1, Window: time.Second}, now); !rr.Allowed || rr.Remaining != 0 {
+		t.Fatalf("default burst = %+v, want limit", rr)
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	ms := NewMemoryRateStore()
+	q := Quota{Limit: 10, Window: 10 * time.Second, Algorithm: SlidingWindow}
+	base := time.Unix(1000, 0) // 窗口起点
+
+	take := func(at time.Duration) RateResult {
+		rr, e := ms.Take("k", q, base.Add(at))
+		if e != nil {
+			t.Fatal(e)
+		}
+		return rr
+	}
+
+	for i := 0; i < 10; i++ {
+		if rr := take(time.Second); !rr.Allowed || rr.Remaining != 9-i {
+			t.Fatalf("take %v = %+v", i, rr)
+		}
+	}
+	if rr := take(time.Second); rr.Allowed || rr.RetryAfter != 9*time.Second {
+		t.Fatalf("over limit = %+v, want retry at window end", rr)
+	}
+
+	// 下一个窗口过去一半, 前一个窗口的10次按一半计入
+	for i := 0; i < 5; i++ {
+		if rr := take(15 * time.Second); !rr.Allowed {
+			t.Fatalf("weighted take %v = %+v", i, rr)
+		}
+	}
+	if rr := take(15 * time.Second); rr.Allowed || rr.Remaining != 0 {
+		t.Fatalf("weighted over limit = %+v", rr)
+	}
+
+	// 超过两个窗口没有请求, 计数清零
+	if rr := take(35 * time.Second); !rr.Allowed || rr.Remaining != 9 {
+		t.Fatalf("after rollover = %+v, want fresh window", rr)
+	}
+}
+
+func TestRateStoreGC(t *testing.T) {
+	ms := NewMemoryRateStore()
+	now := time.Unix(1000, 0)
+	bucket := Quota{Limit: 1, Window: time.Second}
+	window := Quota{Limit: 1, Window: time.Second, Algorithm: SlidingWindow}
+
+	ms.Take("old", bucket, now)
+	ms.Take("old", window, now)
+	ms.Take("busy", bucket, now.Add(59*time.Second))
+
+	ms.Take("new", bucket, now.Add(30*time.Second)) // 距上次清理不足1分钟
+	if len(ms.buckets) != 3 || len(ms.windows) != 1 {
+		t.Fatalf("gc ran early: %v buckets, %v windows", len(ms.buckets), len(ms.windows))
+	}
+
+	ms.Take("new", bucket, now.Add(time.Minute))
+	if _, ok := ms.buckets["old"]; ok || len(ms.buckets) != 2 || len(ms.windows) != 0 {
+		t.Fatalf("gc kept idle keys: %v buckets, %v windows", len(ms.buckets), len(ms.windows))
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	mux := NewMux()
+	ok := func(c *Context, res map[string]interface{}) Error { return nil }
+	mux.Handle("/t/limited", ok, &RouteConfig{RateLimits: map[string]Quota{"api": {Limit: 1, Window: time.Minute}}})
+	mux.Handle("/t/bad", ok, &RouteConfig{RateLimits: map[string]Quota{"api": {Limit: 0, Window: time.Minute}}})
+	mux.Handle("/t/free", ok, nil)
+
+	key := "k"
+	eg := newTestEngine(mux)
+	eg.Use(RateLimit(&RateLimitOption{Name: "api", Key: func(ctx *Context) string { return key }}))
+
+	w := serve(eg, "/t/limited", "{}")
+	h := w.Header()
+	if !strings.Contains(w.Body.String(), `"code":0`) || h.Get("X-RateLimit-Limit") != "1" ||
+		h.Get("X-RateLimit-Remaining") != "0" || h.Get("X-RateLimit-Reset") != "60" || h.Get("Retry-After") != "" {
+		t.Fatalf("first = %s %v", w.Body.String(), h)
+	}
+
+	w = serve(eg, "/t/limited", "{}")
+	if !strings.Contains(w.Body.String(), `"code":-5`) || w.Header().Get("Retry-After") != "60" {
+		t.Fatalf("second = %s %v, want rate limited", w.Body.String(), w.Header())
+	}
+
+	key = "" // 无法确定key时不限流
+	if w = serve(eg, "/t/limited", "{}"); !strings.Contains(w.Body.String(), `"code":0`) {
+		t.Fatalf("empty key = %s, want allowed", w.Body.String())
+	}
+
+	key = "k"
+	for i := 0; i < 3; i++ { // 配额错误时Take失败, 放行
+		if w = serve(eg, "/t/bad", "{}"); !strings.Contains(w.Body.String(), `"code":0`) || w.Header().Get("X-RateLimit-Limit") != "" {
+			t.Fatalf("bad quota = %s %v, want allowed without headers", w.Body.String(), w.Header())
+		}
+	}
+
+	if w = serve(eg, "/t/free", "{}"); w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("route without quota has headers %v", w.Header())
+	}
+}
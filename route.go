@@ -1,5 +1,118 @@
 package mengine
 
+import (
+	"sync"
+	"time"
+)
+
 type Router interface {
 	Rout(path string) (h HFunc, b bool)
 }
+
+// RouteConfig 路由级配置, 在注册路由时声明
+type RouteConfig struct {
+	Name string // 路由名, 用作指标的route标签; Mux注册的路由默认为路径, 其他Router未设置时为"unnamed"
+
+	Roles []string // 需要的角色, 满足其一即可
+	Perms []string // 需要的权限, 需全部满足
+
+	Timeout time.Duration // 处理超时, 包括读取body, 为0时不限制
+
+	RateLimits map[string]Quota // 限流配额, key为RateLimitOption.Name
+
+	MaxInFlight int // 同时处理的请求数, 为0时不限制, 需Use(ConcurrencyLimit)
+
+	NoCompress bool // 不压缩响应
+
+	// 不预先解析body, 首次调用Parse/EnsureBody等时才解析, 也可用BodyReader/Decoder按需读取;
+	// t通道上连body也不预先读取, i/x通道需要完整的body校验或解密, 只跳过解析
+	Stream bool
+
+	persistent bool // 长连接路由, 不受Timeout限制; 由Mux.HandleWebSocket/HandleSSE注册时设置, 不能由请求决定
+}
+
+// ConfigRouter Router的可选扩展, 实现后engine会读取路由级配置
+type ConfigRouter interface {
+	Config(path string) *RouteConfig
+}
+
+var emptyRouteConfig = &RouteConfig{}
+
+// Mux 基于map的Router实现, 支持路由级配置
+type Mux struct {
+	mu     sync.RWMutex
+	routes map[string]muxEntry
+}
+
+type muxEntry struct {
+	h   HFunc
+	cfg *RouteConfig
+}
+
+//
+func NewMux() *Mux {
+	return &Mux{routes: make(map[string]muxEntry)}
+}
+
+// Handle 注册路由, cfg可为nil
+func (m *Mux) Handle(path string, h HFunc, cfg *RouteConfig) {
+	if cfg == nil {
+		cfg = emptyRouteConfig
+	}
+
+	m.mu.Lock()
+	m.routes[path] = muxEntry{h: h, cfg: cfg}
+	m.mu.Unlock()
+}
+
+func (m *Mux) Rout(path string) (h HFunc, b bool) {
+	m.mu.RLock()
+	entry, b := m.routes[path]
+	m.mu.RUnlock()
+	return entry.h, b
+}
+
+func (m *Mux) Config(path string) *RouteConfig {
+	m.mu.RLock()
+	entry, ok := m.routes[path]
+	m.mu.RUnlock()
+
+	if !ok {
+		return emptyRouteConfig
+	}
+	return entry.cfg
+}
+
+// persist 复制一份长连接路由的配置, 不修改调用方的cfg
+func (rc *RouteConfig) persist() *RouteConfig {
+	cp := RouteConfig{}
+	if rc != nil {
+		cp = *rc
+	}
+	cp.persistent = true
+	return &cp
+}
+
+// routeName 指标的route标签, 不能直接用请求路径: 带参数的路径会使每个URL产生一组序列
+func (ctx *Context) routeName() string {
+	if name := ctx.RouteConfig().Name; name != "" {
+		return name
+	}
+
+	if _, ok := ctx.eg.Router.(*Mux); ok { // 按完整路径匹配, 路径即路由
+		return ctx.Request.URL.Path
+	}
+
+	return "unnamed"
+}
+
+// routeConfig 路由级配置, 不会返回nil
+func (eg *Engine) routeConfig(path string) *RouteConfig {
+	if cr, ok := eg.Router.(ConfigRouter); ok {
+		if cfg := cr.Config(path); cfg != nil {
+			return cfg
+		}
+	}
+
+	return emptyRouteConfig
+}
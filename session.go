@@ -0,0 +1,281 @@
+package mengine
+
+import (
+	"container/list"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Session 登录会话, Token即auth cookie的值
+type Session struct {
+	Token    string
+	Uid      int64
+	Device   string
+	CreateAt time.Time
+	ExpireAt time.Time
+}
+
+// SessionStore 会话存储, Get在会话不存在时返回nil, nil
+type SessionStore interface {
+	Get(token string) (*Session, error)
+	Put(s *Session) error
+	Delete(token string) error
+	List(uid int64) ([]*Session, error)
+}
+
+type SessionOption struct {
+	Store    SessionStore
+	TTL      time.Duration // 有效期, 访问时顺延(滑动过期)
+	Secure   bool          // cookie只在https下发送
+	Optional bool          // 未登录时放行, Uid为0
+}
+
+// SessionManager 发放/吊销opaque token, 通过auth cookie下发
+type SessionManager struct {
+	opt *SessionOption
+}
+
+//
+func NewSessionManager(opt *SessionOption) *SessionManager {
+	if opt.TTL <= 0 {
+		opt.TTL = 7 * 24 * time.Hour
+	}
+
+	return &SessionManager{opt: opt}
+}
+
+// Login 为uid创建会话并设置auth cookie
+func (sm *SessionManager) Login(ctx *Context, uid int64, device string) (*Session, error) {
+	token, e := newToken()
+	if e != nil {
+		return nil, e
+	}
+
+	now := time.Now()
+	s := &Session{
+		Token:    token,
+		Uid:      uid,
+		Device:   device,
+		CreateAt: now,
+		ExpireAt: now.Add(sm.opt.TTL),
+	}
+
+	if e = sm.opt.Store.Put(s); e != nil {
+		return nil, e
+	}
+
+	ctx.Uid = uid
+	ctx.SetCookie(sm.cookie(token, s.ExpireAt))
+	return s, nil
+}
+
+// Logout 吊销当前请求的会话并清除cookie
+func (sm *SessionManager) Logout(ctx *Context) error {
+	token := ctx.Token()
+	if token == "" {
+		return nil
+	}
+
+	ctx.SetCookie(sm.cookie("", time.Unix(0, 0)))
+	return sm.opt.Store.Delete(token)
+}
+
+// Revoke 吊销指定会话, 用于踢掉其他设备
+func (sm *SessionManager) Revoke(token string) error {
+	return sm.opt.Store.Delete(token)
+}
+
+// RevokeAll 吊销uid的全部会话
+func (sm *SessionManager) RevokeAll(uid int64) error {
+	sessions, e := sm.opt.Store.List(uid)
+	if e != nil {
+		return e
+	}
+
+	for _, s := range sessions {
+		if e = sm.opt.Store.Delete(s.Token); e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Sessions uid在各设备上的有效会话
+func (sm *SessionManager) Sessions(uid int64) ([]*Session, error) {
+	return sm.opt.Store.List(uid)
+}
+
+// Auth 会话认证中间件, 将auth cookie解析为ctx.Uid, 失败时按authfail返回
+func (sm *SessionManager) Auth() Middleware {
+	return func(h HFunc) HFunc {
+		return func(ctx *Context, res map[string]interface{}) Error {
+			token := ctx.Token()
+			if token == "" {
+				if sm.opt.Optional {
+					return h(ctx, res)
+				}
+				return AuthFailure("session token not provided")
+			}
+
+			s, e := sm.opt.Store.Get(token)
+			if e != nil {
+				return AuthFailure(fmt.Sprintf("session store error %v", e))
+			}
+
+			now := time.Now()
+			if s == nil || !now.Before(s.ExpireAt) {
+				return AuthFailure("session expired")
+			}
+
+			// 剩余时间不足一半时顺延, 减少存储写入
+			if s.ExpireAt.Sub(now) < sm.opt.TTL/2 {
+				s.ExpireAt = now.Add(sm.opt.TTL)
+				if e = sm.opt.Store.Put(s); e == nil {
+					ctx.SetCookie(sm.cookie(token, s.ExpireAt))
+				}
+			}
+
+			ctx.Uid = s.Uid
+			return h(ctx, res)
+		}
+	}
+}
+
+func (sm *SessionManager) cookie(token string, expire time.Time) *http.Cookie {
+	return &http.Cookie{
+		Name:     "auth",
+		Value:    token,
+		Path:     "/",
+		Expires:  expire,
+		Secure:   sm.opt.Secure,
+		HttpOnly: true,
+	}
+}
+
+func newToken() (string, error) {
+	bts := make([]byte, 32)
+	if _, e := rand.Read(bts); e != nil {
+		return "", e
+	}
+
+	return hex.EncodeToString(bts), nil
+}
+
+// MemoryStore 基于LRU的内存会话存储, 超出容量时淘汰最久未访问的会话
+type MemoryStore struct {
+	mu    sync.Mutex
+	cap   int
+	lru   *list.List
+	items map[string]*list.Element
+	uids  map[int64]map[string]struct{}
+}
+
+//
+func NewMemoryStore(capacity int) *MemoryStore {
+	return &MemoryStore{
+		cap:   capacity,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+		uids:  make(map[int64]map[string]struct{}),
+	}
+}
+
+func (ms *MemoryStore) Get(token string) (*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	elem, ok := ms.items[token]
+	if !ok {
+		return nil, nil
+	}
+
+	s := elem.Value.(*Session)
+	if !time.Now().Before(s.ExpireAt) {
+		ms.remove(elem)
+		return nil, nil
+	}
+
+	ms.lru.MoveToFront(elem)
+	cp := *s
+	return &cp, nil
+}
+
+func (ms *MemoryStore) Put(s *Session) error {
+	if s == nil || s.Token == "" {
+		return errors.New("invalid session")
+	}
+
+	cp := *s
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if elem, ok := ms.items[s.Token]; ok {
+		ms.remove(elem)
+	}
+
+	ms.items[cp.Token] = ms.lru.PushFront(&cp)
+	tokens, ok := ms.uids[cp.Uid]
+	if !ok {
+		tokens = make(map[string]struct{})
+		ms.uids[cp.Uid] = tokens
+	}
+	tokens[cp.Token] = struct{}{}
+
+	for ms.cap > 0 && ms.lru.Len() > ms.cap {
+		ms.remove(ms.lru.Back())
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) Delete(token string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	if elem, ok := ms.items[token]; ok {
+		ms.remove(elem)
+	}
+
+	return nil
+}
+
+func (ms *MemoryStore) List(uid int64) ([]*Session, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	sessions := make([]*Session, 0, len(ms.uids[uid]))
+	for token := range ms.uids[uid] {
+		elem := ms.items[token]
+		s := elem.Value.(*Session)
+		if !now.Before(s.ExpireAt) {
+			ms.remove(elem)
+			continue
+		}
+
+		cp := *s
+		sessions = append(sessions, &cp)
+	}
+
+	return sessions, nil
+}
+
+// remove 需持有锁
+func (ms *MemoryStore) remove(elem *list.Element) {
+	s := ms.lru.Remove(elem).(*Session)
+	delete(ms.items, s.Token)
+
+	if tokens, ok := ms.uids[s.Uid]; ok {
+		delete(tokens, s.Token)
+		if len(tokens) <= 0 {
+			delete(ms.uids, s.Uid)
+		}
+	}
+}
@@ -0,0 +1,113 @@
+package mengine
+
+import (
+	"sort"
+	"testing"
+	"time"
+)
+
+func putSession(t *testing.T, ms *MemoryStore, token string, uid int64, ttl time.Duration) {
+	if e := ms.Put(&Session{Token: token, Uid: uid, ExpireAt: time.Now().Add(ttl)}); e != nil {
+		t.Fatal(e)
+	}
+}
+
+func listTokens(t *testing.T, ms *MemoryStore, uid int64) []string {
+	sessions, e := ms.List(uid)
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	tokens := make([]string, 0, len(sessions))
+	for _, s := range sessions {
+		tokens = append(tokens, s.Token)
+	}
+	sort.Strings(tokens)
+	return tokens
+}
+
+// 超出容量时淘汰最久未访问的会话, Get算作访问
+func TestMemoryStoreLRU(t *testing.T) {
+	ms := NewMemoryStore(2)
+	putSession(t, ms, "a", 1, time.Hour)
+	putSession(t, ms, "b", 1, time.Hour)
+
+	if s, _ := ms.Get("a"); s == nil {
+		t.Fatal("a missing")
+	}
+	putSession(t, ms, "c", 2, time.Hour)
+
+	if s, _ := ms.Get("b"); s != nil {
+		t.Fatal("b should be evicted")
+	}
+	if s, _ := ms.Get("a"); s == nil || s.Uid != 1 {
+		t.Fatalf("a = %+v, want kept", s)
+	}
+	if got := listTokens(t, ms, 1); len(got) != 1 || got[0] != "a" {
+		t.Fatalf("List(1) = %v, want [a]", got)
+	}
+
+	// 同一token再次Put不占用额外容量
+	putSession(t, ms, "c", 2, time.Hour)
+	putSession(t, ms, "c", 3, time.Hour)
+	if s, _ := ms.Get("a"); s == nil {
+		t.Fatal("a evicted by repeated put")
+	}
+	if got := listTokens(t, ms, 2); len(got) != 0 {
+		t.Fatalf("List(2) = %v, want moved to uid 3", got)
+	}
+	if got := listTokens(t, ms, 3); len(got) != 1 {
+		t.Fatalf("List(3) = %v, want [c]", got)
+	}
+}
+
+func TestMemoryStoreList(t *testing.T) {
+	ms := NewMemoryStore(0)
+	putSession(t, ms, "a", 1, time.Hour)
+	putSession(t, ms, "b", 1, time.Hour)
+	putSession(t, ms, "old", 1, -time.Second)
+	putSession(t, ms, "c", 2, time.Hour)
+
+	if got := listTokens(t, ms, 1); len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Fatalf("List(1) = %v, want [a b] without expired", got)
+	}
+	if _, ok := ms.items["old"]; ok {
+		t.Fatal("expired session not removed by List")
+	}
+	if s, _ := ms.Get("a"); s == nil {
+		t.Fatal("a missing")
+	} else if s.ExpireAt = time.Now(); len(listTokens(t, ms, 1)) != 2 { // Get返回副本
+		t.Fatal("Get returned the stored session")
+	}
+
+	if got := listTokens(t, ms, 3); len(got) != 0 {
+		t.Fatalf("List(3) = %v, want empty", got)
+	}
+}
+
+func TestRevokeAll(t *testing.T) {
+	ms := NewMemoryStore(0)
+	sm := NewSessionManager(&SessionOption{Store: ms})
+	putSession(t, ms, "a", 1, time.Hour)
+	putSession(t, ms, "b", 1, time.Hour)
+	putSession(t, ms, "c", 2, time.Hour)
+
+	if e := sm.RevokeAll(1); e != nil {
+		t.Fatal(e)
+	}
+	for _, token := range []string{"a", "b"} {
+		if s, _ := ms.Get(token); s != nil {
+			t.Errorf("%v not revoked", token)
+		}
+	}
+	if s, _ := ms.Get("c"); s == nil {
+		t.Error("other uid's session revoked")
+	}
+	if len(ms.uids[1]) != 0 {
+		t.Errorf("uid index = %v, want cleared", ms.uids[1])
+	}
+
+	if e := sm.Revoke("c"); e != nil || len(ms.items) != 0 {
+		t.Fatalf("Revoke = %v, %v sessions left", e, len(ms.items))
+	}
+}
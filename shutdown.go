@@ -0,0 +1,191 @@
+package mengine
+
+import (
+	oscontext "context"
+	"errors"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+type shutdownHook struct {
+	name string
+	fn   func(ctx oscontext.Context) error
+}
+
+// OnShutdown 注册关闭回调, 在处理中的请求结束(或超时)后按注册顺序执行
+func (eg *Engine) OnShutdown(name string, fn func(ctx oscontext.Context) error) {
+	eg.mu.Lock()
+	eg.hooks = append(eg.hooks, shutdownHook{name: name, fn: fn})
+	eg.mu.Unlock()
+}
+
+// Draining 是否已开始关闭
+func (eg *Engine) Draining() bool {
+	return atomic.LoadInt32(&eg.draining) == 1
+}
+
+// RunUntilSignal 运行直到收到SIGINT/SIGTERM, 然后优雅关闭;
+// drained表示处理中的请求是否在ShutdownTimeout内全部完成
+func (eg *Engine) RunUntilSignal() (drained bool, e error) {
+	return eg.untilSignal(eg.Run)
+}
+
+// RunTLSUntilSignal 同RunUntilSignal, 以RunTLS方式运行
+func (eg *Engine) RunTLSUntilSignal(certFile, keyFile string) (drained bool, e error) {
+	return eg.untilSignal(func() error {
+		return eg.RunTLS(eg.Addr, certFile, keyFile)
+	})
+}
+
+func (eg *Engine) untilSignal(run func() error) (bool, error) {
+	errc := make(chan error, 1)
+	go func() {
+		errc <- run()
+	}()
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigc)
+
+	select {
+	case e := <-errc: // 启动失败
+		return false, e
+	case sig := <-sigc:
+		eg.Info().Str("signal", sig.String()).Msg("shutdown")
+	}
+
+	timeout := eg.ShutdownTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+
+	drained, e := eg.shutdown(timeout)
+	if re := <-errc; re != nil && re != http.ErrServerClosed && e == nil {
+		e = re
+	}
+
+	return drained, e
+}
+
+// shutdown readyz先失败, WebSocket连接以1001关闭, 等待ReadinessGrace后停止接收新连接,
+// 等待处理中的请求和WebSocket处理函数, 再依次执行回调
+func (eg *Engine) shutdown(timeout time.Duration) (drained bool, e error) {
+	deadline := time.Now().Add(timeout)
+	if atomic.CompareAndSwapInt32(&eg.draining, 0, 1) {
+		close(eg.drain)
+	}
+
+	eg.mu.Lock()
+	svr := eg.svr
+	hooks := append([]shutdownHook(nil), eg.hooks...)
+	eg.mu.Unlock()
+
+	drained = true
+	if svr != nil {
+		if grace := eg.ReadinessGrace; grace > 0 { // 期间仍正常处理请求, 只有readyz失败
+			if grace > timeout {
+				grace = timeout
+			}
+			eg.Info().Str("grace", grace.String()).Msg("readiness grace")
+			time.Sleep(grace)
+		}
+
+		ctx, cancel := oscontext.WithDeadline(oscontext.Background(), deadline)
+		e = svr.Shutdown(ctx)
+		cancel()
+
+		if errors.Is(e, oscontext.DeadlineExceeded) {
+			drained = false
+			eg.Error().Str("timeout", timeout.String()).Msg("drain timeout")
+		}
+	}
+
+	if !eg.waitWS(deadline) { // 被劫持的连接不在Server.Shutdown的等待之内
+		drained = false
+		eg.Error().Str("timeout", timeout.String()).Msg("websocket drain timeout")
+	}
+
+	for _, hook := range hooks { // 每个回调单独计时, 不受排空超时影响
+		ctx, cancel := oscontext.WithTimeout(oscontext.Background(), timeout)
+		if he := hook.fn(ctx); he != nil {
+			eg.Error().Str("hook", hook.name).Str("detail", he.Error()).Msg("shutdown hook fail")
+			if e == nil {
+				e = he
+			}
+		}
+		cancel()
+	}
+
+	eg.Info().Str("drained", strconv.FormatBool(drained)).Msg("shutdown done")
+	return drained, e
+}
+
+// trackWS 登记升级后的连接, 已开始关闭时返回false
+func (eg *Engine) trackWS(wc *WSConn) bool {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+
+	if eg.Draining() {
+		return false
+	}
+
+	if eg.wsconns == nil {
+		eg.wsconns = make(map[*WSConn]struct{})
+	}
+	eg.wsconns[wc] = struct{}{}
+	return true
+}
+
+// untrackWS 处理函数已返回
+func (eg *Engine) untrackWS(wc *WSConn) {
+	eg.mu.Lock()
+	delete(eg.wsconns, wc)
+	eg.mu.Unlock()
+
+	close(wc.served)
+}
+
+// waitWS 等待登记的连接的处理函数返回, 超过deadline返回false
+func (eg *Engine) waitWS(deadline time.Time) bool {
+	eg.mu.Lock()
+	conns := make([]*WSConn, 0, len(eg.wsconns))
+	for wc := range eg.wsconns {
+		conns = append(conns, wc)
+	}
+	eg.mu.Unlock()
+
+	if len(conns) == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	for _, wc := range conns {
+		select {
+		case <-wc.served:
+		case <-timer.C:
+			return false
+		}
+	}
+
+	return true
+}
+
+// setServer 已开始关闭时返回false, 避免关闭后才启动的server无法退出
+func (eg *Engine) setServer(s *http.Server) bool {
+	eg.mu.Lock()
+	defer eg.mu.Unlock()
+
+	if eg.Draining() {
+		return false
+	}
+
+	eg.svr = s
+	return true
+}
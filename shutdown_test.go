@@ -0,0 +1,163 @@
+package mengine
+
+import (
+	oscontext "context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startEngine 在随机端口上运行eg, 返回地址
+func startEngine(t *testing.T, eg *Engine) string {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	s := &http.Server{Handler: eg}
+	if !eg.setServer(s) {
+		t.Fatal("engine already draining")
+	}
+	go s.Serve(ln)
+	return "http://" + ln.Addr().String()
+}
+
+func postURL(url string) (int, string, error) {
+	resp, e := http.Post(url, "application/json", strings.NewReader("{}"))
+	if e != nil {
+		return 0, "", e
+	}
+	defer resp.Body.Close()
+
+	bts, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(bts), nil
+}
+
+// readyz先失败, grace期间仍处理新请求, 处理中的请求结束后再按注册顺序执行回调
+func TestShutdownOrder(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan string, 1)
+	eg := newTestEngine(blockingMux(release, entered, map[string]*RouteConfig{"/t/slow": nil}))
+	eg.ReadinessGrace = 100 * time.Millisecond
+	addr := startEngine(t, eg)
+
+	var mu sync.Mutex
+	var events []string
+	record := func(ev string) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}
+
+	eg.OnShutdown("first", func(ctx oscontext.Context) error {
+		record("first")
+		return nil
+	})
+	eg.OnShutdown("second", func(ctx oscontext.Context) error {
+		record("second")
+		return errors.New("second failed")
+	})
+	eg.OnShutdown("third", func(ctx oscontext.Context) error {
+		record("third")
+		return nil
+	})
+
+	slow := make(chan string, 1)
+	go func() {
+		_, body, _ := postURL(addr + "/t/slow")
+		record("slow done")
+		slow <- body
+	}()
+	<-entered
+
+	type result struct {
+		drained bool
+		e       error
+	}
+	done := make(chan result, 1)
+	go func() {
+		drained, e := eg.shutdown(time.Second)
+		done <- result{drained, e}
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if !eg.Draining() {
+		t.Fatal("not draining")
+	}
+	if code, _, e := postURL(addr + ReadyzPath); e != nil || code != http.StatusServiceUnavailable {
+		t.Fatalf("readyz during grace = %v, %v, want 503", code, e)
+	}
+	if _, body, e := postURL(addr + "/t/fast"); e != nil || !strings.Contains(body, `"code":0`) {
+		t.Fatalf("request during grace = %s, %v, want served", body, e)
+	}
+
+	time.Sleep(150 * time.Millisecond) // grace已过, 不再接收新连接
+	if _, _, e := postURL(addr + "/t/fast"); e == nil {
+		t.Fatal("new connection accepted after grace")
+	}
+
+	record("release")
+	close(release)
+	if body := <-slow; !strings.Contains(body, `"code":0`) {
+		t.Fatalf("in-flight request = %s, want completed", body)
+	}
+
+	r := <-done
+	if !r.drained || r.e == nil || r.e.Error() != "second failed" {
+		t.Fatalf("shutdown = %v, %v, want drained with hook error", r.drained, r.e)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if got := strings.Join(events, ","); got != "release,slow done,first,second,third" {
+		t.Fatalf("order = %v", got)
+	}
+}
+
+// 排空超时后回调仍然执行, 每个回调单独计时
+func TestShutdownTimeout(t *testing.T) {
+	release, entered := make(chan struct{}), make(chan string, 1)
+	defer close(release)
+	eg := newTestEngine(blockingMux(release, entered, map[string]*RouteConfig{"/t/slow": nil}))
+	eg.ReadinessGrace = time.Hour // 不超过关闭的超时
+	addr := startEngine(t, eg)
+
+	go postURL(addr + "/t/slow")
+	<-entered
+
+	timeout := 100 * time.Millisecond
+	var remains []time.Duration
+	for _, name := range []string{"a", "b"} {
+		eg.OnShutdown(name, func(ctx oscontext.Context) error {
+			deadline, _ := ctx.Deadline()
+			remains = append(remains, time.Until(deadline))
+			<-ctx.Done() // 用满自己的时间
+			return nil
+		})
+	}
+
+	start := time.Now()
+	drained, e := eg.shutdown(timeout)
+	if drained || e == nil {
+		t.Fatalf("shutdown = %v, %v, want drain timeout", drained, e)
+	}
+	if elapsed := time.Since(start); elapsed < 3*timeout || elapsed > 3*timeout+time.Second {
+		t.Fatalf("shutdown took %v, want drain and each hook bounded by %v", elapsed, timeout)
+	}
+	if len(remains) != 2 {
+		t.Fatalf("%v hooks ran, want 2", len(remains))
+	}
+	for i, remain := range remains {
+		if remain < timeout/2 || remain > timeout {
+			t.Errorf("hook %v started with %v left, want its own %v", i, remain, timeout)
+		}
+	}
+
+	if eg.setServer(&http.Server{}) {
+		t.Error("server set after shutdown")
+	}
+}
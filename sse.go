@@ -0,0 +1,234 @@
+package mengine
+
+import (
+	"errors"
+	"fmt"
+	"github.com/wxiaowar/mengine/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SSEFunc Server-Sent Events处理函数, 返回后流结束; 返回的错误以error事件发送给客户端
+type SSEFunc func(ctx *Context, s *SSEStream) Error
+
+type SSEOption struct {
+	Heartbeat time.Duration // 心跳间隔, 防止代理断开空闲连接, 默认15秒
+	Retry     time.Duration // 建议客户端断线重连的间隔, 为0时由客户端决定
+}
+
+var errStreamClosed = errors.New("stream closed")
+
+// SSE 将SSEFunc适配为HFunc注册到路由, 中间件与t/i通道的白名单、完整性校验照常执行, 失败时按普通接口返回;
+// x通道无法逐条加密, 不支持. 客户端断开或引擎开始关闭时SSEStream.Done()被关闭;
+// 设置了Timeout的路由需用Mux.HandleSSE注册, 否则无法开始流
+func SSE(h SSEFunc, opt *SSEOption) HFunc {
+	if opt == nil {
+		opt = &SSEOption{}
+	}
+	if opt.Heartbeat <= 0 {
+		opt.Heartbeat = 15 * time.Second
+	}
+
+	return func(ctx *Context, res map[string]interface{}) Error {
+		if strings.HasPrefix(ctx.Path(), "/x/") {
+			return NewFailure(CodeInternal, "internal", "sse not supported on encrypted route")
+		}
+
+		s, e := startStream(ctx, opt)
+		if e != nil {
+			return NewFailure(CodeInternal, "internal", fmt.Sprintf("sse error: %v", e))
+		}
+		defer s.close()
+
+		se := h(ctx, s)
+		if se != nil {
+			result := map[string]interface{}{
+				"code": se.Code(),
+				"msg":  se.Msg(),
+			}
+			if ctx.eg.IsDebug {
+				result["detail"] = se.Detail()
+			}
+			s.Send("error", result)
+		}
+
+		return se
+	}
+}
+
+// HandleSSE 注册SSE路由, cfg的Timeout对其不生效, cfg可为nil
+func (m *Mux) HandleSSE(path string, h SSEFunc, opt *SSEOption, cfg *RouteConfig) {
+	m.Handle(path, SSE(h, opt), cfg.persist())
+}
+
+// SSEStream 事件流, 可在多个goroutine中使用, 处理函数返回后不能再使用
+type SSEStream struct {
+	ctx    *Context
+	w      http.ResponseWriter
+	rc     *http.ResponseController
+	mu     sync.Mutex
+	closed bool
+	stop   chan struct{}
+	done   chan struct{}
+	quit   chan struct{} // 见Done
+}
+
+func startStream(ctx *Context, opt *SSEOption) (*SSEStream, error) {
+	w := ctx.writer
+	if _, ok := w.(http.Flusher); !ok {
+		return nil, errors.New("response writer can not flush")
+	}
+
+	s := &SSEStream{
+		ctx:  ctx,
+		w:    w,
+		rc:   http.NewResponseController(w),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+		quit: make(chan struct{}),
+	}
+
+	s.rc.SetWriteDeadline(time.Time{}) // 长连接不受Server.WriteTimeout限制
+
+	header := w.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no") // nginx不缓冲
+	header.Del("Content-Length")
+	w.WriteHeader(http.StatusOK)
+	atomic.StoreInt32(&ctx.streamed, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if opt.Retry > 0 {
+		s.write("retry: " + strconv.FormatInt(int64(opt.Retry/time.Millisecond), 10) + "\n\n")
+	}
+	if e := s.flush(); e != nil {
+		return nil, e
+	}
+
+	go s.heartbeat(opt.Heartbeat)
+	return s, nil
+}
+
+// LastEventID 客户端断线重连时带上的最后一个事件id, 用于从断点继续发送
+func (s *SSEStream) LastEventID() string {
+	if id := s.ctx.Request.Header.Get("Last-Event-ID"); id != "" {
+		return id
+	}
+
+	return s.ctx.Request.URL.Query().Get("lastEventId") // 不支持自定义头的客户端
+}
+
+// Done 客户端断开或引擎开始关闭, 处理函数应随之返回, 否则优雅关闭要等到超时
+func (s *SSEStream) Done() <-chan struct{} {
+	return s.quit
+}
+
+// Send 发送事件, event为空时客户端按message处理; data为string/[]byte时原样发送, 其他按json编码
+func (s *SSEStream) Send(event string, data interface{}) error {
+	return s.SendID("", event, data)
+}
+
+// SendID 发送带id的事件, 客户端重连时以Last-Event-ID带回
+func (s *SSEStream) SendID(id, event string, data interface{}) error {
+	var text string
+	switch x := data.(type) {
+	case string:
+		text = x
+	case []byte:
+		text = string(x)
+	default:
+		bts, e := json.Marshal(data)
+		if e != nil {
+			return e
+		}
+		text = string(bts)
+	}
+
+	var b strings.Builder
+	if id != "" {
+		b.WriteString("id: " + oneLine(id) + "\n")
+	}
+	if event != "" {
+		b.WriteString("event: " + oneLine(event) + "\n")
+	}
+	for _, line := range strings.Split(strings.Replace(text, "\r\n", "\n", -1), "\n") {
+		b.WriteString("data: " + line + "\n")
+	}
+	b.WriteString("\n")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return errStreamClosed
+	}
+	if e := s.ctx.Request.Context().Err(); e != nil {
+		return e
+	}
+
+	if e := s.write(b.String()); e != nil {
+		return e
+	}
+
+	return s.flush()
+}
+
+// heartbeat 定时发送注释行保持连接, 客户端断开或引擎开始关闭时关闭quit
+func (s *SSEStream) heartbeat(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.ctx.Request.Context().Done():
+			close(s.quit)
+			return
+		case <-s.ctx.eg.drain:
+			close(s.quit)
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if !s.closed && s.write(": ping\n\n") == nil {
+				s.flush()
+			}
+			s.mu.Unlock()
+		}
+	}
+}
+
+// close 处理函数返回时结束心跳, 之后Send返回错误
+func (s *SSEStream) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+
+	close(s.stop)
+	<-s.done
+}
+
+// write 需持有锁
+func (s *SSEStream) write(text string) error {
+	_, e := s.w.Write([]byte(text))
+	return e
+}
+
+// flush 需持有锁
+func (s *SSEStream) flush() error {
+	return s.rc.Flush()
+}
+
+// oneLine id和event不能包含换行
+func oneLine(s string) string {
+	return strings.NewReplacer("\r", "", "\n", "").Replace(s)
+}
@@ -0,0 +1,69 @@
+package mengine
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 优雅关闭时SSE的Done被关闭, 处理函数返回后排空不需要等到超时
+func TestSSEDoneOnShutdown(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/events", SSE(func(c *Context, s *SSEStream) Error {
+		s.Send("hello", "world")
+		<-s.Done()
+		return nil
+	}, nil), nil)
+	eg := newTestEngine(mux)
+
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	svr := &http.Server{Handler: eg}
+	eg.setServer(svr)
+	go svr.Serve(ln)
+
+	resp, e := http.Get("http://" + ln.Addr().String() + "/t/events")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	if line, e := bufio.NewReader(resp.Body).ReadString('\n'); e != nil || line != "event: hello\n" {
+		t.Fatalf("first line = %q, %v", line, e)
+	}
+
+	start := time.Now()
+	drained, e := eg.shutdown(5 * time.Second)
+	if !drained || e != nil || time.Since(start) > 2*time.Second {
+		t.Fatalf("shutdown = %v, %v after %v, want drained promptly", drained, e, time.Since(start))
+	}
+}
+
+// HandleSSE注册的路由设置了Timeout仍能开始流, 超时后继续发送
+func TestSSERouteTimeout(t *testing.T) {
+	mux := NewMux()
+	mux.HandleSSE("/t/events", func(c *Context, s *SSEStream) Error {
+		time.Sleep(50 * time.Millisecond)
+		s.Send("late", "1")
+		return nil
+	}, nil, &RouteConfig{Timeout: 10 * time.Millisecond})
+
+	srv := httptest.NewServer(newTestEngine(mux))
+	defer srv.Close()
+
+	resp, e := http.Get(srv.URL + "/t/events")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want event stream", ct)
+	}
+	if line, e := bufio.NewReader(resp.Body).ReadString('\n'); e != nil || line != "event: late\n" {
+		t.Fatalf("first line = %q, %v", line, e)
+	}
+}
@@ -0,0 +1,80 @@
+package mengine
+
+import (
+	"bytes"
+	"errors"
+	"github.com/wxiaowar/mengine/json"
+	"io"
+)
+
+// body的读取状态, 见RouteConfig.Stream
+const (
+	bodyParsed   uint8 = iota // BodyRaw已读取, Body已解析
+	bodyRaw                   // BodyRaw已读取, Body未解析
+	bodyStream                // body未读取, 由处理函数从请求流中读取
+	bodyConsumed              // 请求流已交给处理函数
+)
+
+var (
+	errBodyConsumed = errors.New("body stream already consumed")
+	errBodyNotJson  = errors.New("body is not json")
+)
+
+// materialize Stream路由在首次用到Body时才读取并解析
+func (ctx *Context) materialize() error {
+	switch ctx.body {
+	case bodyStream:
+		buf := bufferPool.Get().(*bytes.Buffer)
+		ctx.buf = buf
+		if e := ctx.eg.inflate(buf, ctx.Request.Body, ctx.Request.Header.Get("Content-Encoding")); e != nil {
+			ctx.body = bodyConsumed
+			return e
+		}
+		ctx.BodyRaw = buf.Bytes()
+		ctx.body = bodyRaw
+		fallthrough
+
+	case bodyRaw:
+		if e := ctx.parseBody(); e != nil {
+			return e
+		}
+		ctx.body = bodyParsed
+
+	case bodyConsumed:
+		return errBodyConsumed
+	}
+
+	return nil
+}
+
+// BodyReader 读取body的流. Stream路由在t通道上直接读取请求(已解压), 只能读取一次, 之后不能再用Body/Parse;
+// 其他情况(i/x通道需要完整的body校验或解密)为BodyRaw的reader
+func (ctx *Context) BodyReader() (io.Reader, error) {
+	ctx.guard()
+	switch ctx.body {
+	case bodyStream:
+		ctx.body = bodyConsumed
+		return ctx.eg.inflateReader(ctx.Request.Body, ctx.Request.Header.Get("Content-Encoding"))
+	case bodyConsumed:
+		return nil, errBodyConsumed
+	}
+
+	return bytes.NewReader(ctx.BodyRaw), nil
+}
+
+// Decoder 从body流按需解码json, 数字为json.Number, 使用json.Use选择的实现;
+// 大数组可先用Token读到'[', 再以More/Decode逐个读取元素
+func (ctx *Context) Decoder() (json.Decoder, error) {
+	if _, ok := ctx.bodyCodec().(jsonCodec); !ok {
+		return nil, errBodyNotJson
+	}
+
+	r, e := ctx.BodyReader()
+	if e != nil {
+		return nil, e
+	}
+
+	decoder := json.NewDecoder(r)
+	decoder.UseNumber()
+	return decoder, nil
+}
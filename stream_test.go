@@ -0,0 +1,53 @@
+package mengine
+
+import (
+	"github.com/wxiaowar/mengine/json"
+	"strings"
+	"testing"
+)
+
+// 解析失败不能被当作缺少字段
+func TestEnsureBodyMalformedStream(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/stream", func(c *Context, res map[string]interface{}) Error {
+		if key, ok := c.EnsureBody("uid"); !ok {
+			return NewFailure(1001, "missing "+key, "")
+		}
+		return nil
+	}, &RouteConfig{Stream: true})
+
+	w := serve(newTestEngine(mux), "/t/stream", `{"uid":`)
+	if body := w.Body.String(); !strings.Contains(body, `"code":-1`) || strings.Contains(body, "missing") {
+		t.Fatalf("malformed stream body = %s, want readbody error", body)
+	}
+}
+
+// Decoder的Token/More可逐个读取大数组
+func TestDecoderTokenStream(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/stream", func(c *Context, res map[string]interface{}) Error {
+		dec, e := c.Decoder()
+		if e != nil {
+			return NewFailure(1001, "decoder", e.Error())
+		}
+		if tok, e := dec.Token(); e != nil || tok != json.Delim('[') {
+			return NewFailure(1002, "token", "want [")
+		}
+
+		var uids []interface{}
+		for dec.More() {
+			var item map[string]interface{}
+			if e = dec.Decode(&item); e != nil {
+				return NewFailure(1003, "decode", e.Error())
+			}
+			uids = append(uids, item["uid"])
+		}
+		res["uids"] = uids
+		return nil
+	}, &RouteConfig{Stream: true})
+
+	w := serve(newTestEngine(mux), "/t/stream", `[{"uid":9007199254740993},{"uid":2}]`)
+	if body := w.Body.String(); !strings.Contains(body, `"uids":[9007199254740993,2]`) {
+		t.Fatalf("stream = %s", body)
+	}
+}
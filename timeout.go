@@ -0,0 +1,139 @@
+package mengine
+
+import (
+	"bytes"
+	oscontext "context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Context实现context.Context, 由请求的context支撑: 客户端断开或超过RouteConfig.Timeout时Done被关闭
+
+func (ctx *Context) Deadline() (deadline time.Time, ok bool) {
+	ctx.guard()
+	return ctx.Request.Context().Deadline()
+}
+
+func (ctx *Context) Done() <-chan struct{} {
+	ctx.guard()
+	return ctx.Request.Context().Done()
+}
+
+func (ctx *Context) Err() error {
+	ctx.guard()
+	return ctx.Request.Context().Err()
+}
+
+// Value string类型的key先查找Set保存的数据
+func (ctx *Context) Value(key interface{}) interface{} {
+	ctx.guard()
+	if k, ok := key.(string); ok {
+		if v, exist := ctx.Get(k); exist {
+			return v
+		}
+	}
+
+	return ctx.Request.Context().Value(key)
+}
+
+var _ oscontext.Context = (*Context)(nil)
+
+// call 执行处理函数, 设置了超时的路由在超时后不再等待处理函数, 直接返回CodeTimeout;
+// 处理函数写入的是缓冲的timeoutWriter, 先于超时返回时才复制到真正的响应,
+// 超时后的写入被丢弃. 此时ctx和res由处理函数独占, 调用方不能再读取, 也不回收.
+// 长连接路由(见Mux.HandleWebSocket/HandleSSE)不设超时, 否则超时的回复会写入已升级的连接或流中
+func (eg *Engine) call(h HFunc, ctx *Context, res map[string]interface{}) Error {
+	rc := ctx.RouteConfig()
+	timeout := rc.Timeout
+	if timeout <= 0 || rc.persistent {
+		return h(ctx, res)
+	}
+
+	tw := &timeoutWriter{w: ctx.writer, h: ctx.writer.Header().Clone()}
+	ctx.writer = tw
+
+	done := make(chan Error, 1)
+	go func() {
+		done <- h(ctx, res)
+	}()
+
+	select {
+	case se := <-done:
+		ctx.writer = tw.w
+		tw.flush()
+		return se
+	case <-ctx.Request.Context().Done():
+		tw.timeout()
+		ctx.detached = true
+		if e := ctx.Request.Context().Err(); e != oscontext.DeadlineExceeded {
+			return NewFailure(CodeInternal, "internal", fmt.Sprintf("request canceled: %v", e))
+		}
+		return TimeoutFailure(fmt.Sprintf("handler timeout: %v", timeout))
+	}
+}
+
+// timeoutWriter 与http.TimeoutHandler一致, 处理函数的header和body先写入缓冲
+type timeoutWriter struct {
+	w    http.ResponseWriter
+	h    http.Header
+	buf  bytes.Buffer
+	code int
+
+	mu       sync.Mutex
+	timedOut bool
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.h
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.code == 0 {
+		tw.code = http.StatusOK
+	}
+
+	return tw.buf.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(code int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.timedOut || tw.code != 0 {
+		return
+	}
+	tw.code = code
+}
+
+// timeout 之后处理函数的写入都被丢弃
+func (tw *timeoutWriter) timeout() {
+	tw.mu.Lock()
+	tw.timedOut = true
+	tw.mu.Unlock()
+}
+
+// flush 处理函数已返回, 将缓冲的header和body写入真正的响应
+func (tw *timeoutWriter) flush() {
+	dst := tw.w.Header()
+	for k := range dst {
+		delete(dst, k)
+	}
+	for k, vv := range tw.h {
+		dst[k] = vv
+	}
+
+	if tw.code != 0 {
+		tw.w.WriteHeader(tw.code)
+	}
+	if tw.buf.Len() > 0 {
+		tw.w.Write(tw.buf.Bytes())
+	}
+}
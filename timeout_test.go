@@ -0,0 +1,70 @@
+package mengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 超时后处理函数仍在运行, 写header不能与引擎的输出竞争(go test -race)
+func TestTimeoutDetachesWriter(t *testing.T) {
+	mux := NewMux()
+	done := make(chan struct{})
+	mux.Handle("/t/slow", func(c *Context, res map[string]interface{}) Error {
+		defer close(done)
+		time.Sleep(50 * time.Millisecond)
+		c.SetCookie(&http.Cookie{Name: "late", Value: "1"})
+		res["late"] = true
+		return nil
+	}, &RouteConfig{Timeout: 10 * time.Millisecond})
+	mux.Handle("/t/fast", func(c *Context, res map[string]interface{}) Error {
+		c.SetCookie(&http.Cookie{Name: "fast", Value: "1"})
+		return nil
+	}, &RouteConfig{Timeout: time.Second})
+
+	srv := httptest.NewServer(newTestEngine(mux))
+	defer srv.Close()
+
+	resp, e := http.Post(srv.URL+"/t/slow", "application/json", strings.NewReader("{}"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	body := make([]byte, 256)
+	n, _ := resp.Body.Read(body)
+	resp.Body.Close()
+	if !strings.Contains(string(body[:n]), `"code":-4`) || resp.Header.Get("Set-Cookie") != "" {
+		t.Fatalf("slow = %s %v, want timeout without cookie", body[:n], resp.Header)
+	}
+	<-done
+
+	resp, e = http.Post(srv.URL+"/t/fast", "application/json", strings.NewReader("{}"))
+	if e != nil {
+		t.Fatal(e)
+	}
+	resp.Body.Close()
+	if resp.Header.Get("Set-Cookie") != "fast=1" {
+		t.Fatalf("fast cookie = %q, want fast=1", resp.Header.Get("Set-Cookie"))
+	}
+}
+
+// 普通路由带上Upgrade头仍然超时, 是否豁免由注册决定而不是请求
+func TestTimeoutIgnoresUpgradeHeader(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/slow", func(c *Context, res map[string]interface{}) Error {
+		time.Sleep(100 * time.Millisecond)
+		return nil
+	}, &RouteConfig{Timeout: 20 * time.Millisecond})
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/t/slow", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+
+	start := time.Now()
+	newTestEngine(mux).ServeHTTP(w, r)
+	if !strings.Contains(w.Body.String(), `"code":-4`) || time.Since(start) > 80*time.Millisecond {
+		t.Fatalf("spoofed upgrade = %s after %v, want timeout", w.Body.String(), time.Since(start))
+	}
+}
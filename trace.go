@@ -0,0 +1,239 @@
+package mengine
+
+import (
+	oscontext "context"
+	"crypto/rand"
+	"encoding/hex"
+	"github.com/wxiaowar/mengine/json"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SpanExporter 导出已结束的span, 只会收到采样的span
+type SpanExporter interface {
+	Export(s *Span)
+}
+
+// Span 一次处理过程, ID为小写hex, 兼容W3C traceparent
+type Span struct {
+	TraceID    string            `json:"trace_id"`
+	SpanID     string            `json:"span_id"`
+	ParentID   string            `json:"parent_id,omitempty"`
+	Name       string            `json:"name"`
+	Start      time.Time         `json:"start"`
+	End        time.Time         `json:"end"`
+	Attrs      map[string]string `json:"attrs,omitempty"`
+	TraceState string            `json:"tracestate,omitempty"`
+	Sampled    bool              `json:"-"`
+
+	mu       sync.Mutex
+	exporter SpanExporter
+}
+
+type spanKey struct{}
+
+// startSpan 按traceparent/tracestate继续上游的trace, 没有或非法时开启新trace
+func (eg *Engine) startSpan(r *http.Request) *Span {
+	if eg.TraceExporter == nil {
+		return nil
+	}
+
+	s := &Span{
+		Name:     r.URL.Path,
+		Start:    time.Now(),
+		Attrs:    make(map[string]string),
+		Sampled:  true,
+		exporter: eg.TraceExporter,
+	}
+
+	if traceID, parentID, flags, ok := parseTraceParent(r.Header.Get("traceparent")); ok {
+		s.TraceID = traceID
+		s.ParentID = parentID
+		s.Sampled = flags&0x01 == 0x01
+		s.TraceState = r.Header.Get("tracestate")
+	} else {
+		s.TraceID = randomHex(16)
+	}
+	s.SpanID = randomHex(8)
+
+	return s
+}
+
+// Span 当前请求的span, 未设置EngionOption.TraceExporter时为nil, 其方法可安全调用
+func (ctx *Context) Span() *Span {
+	return spanFrom(ctx.Request)
+}
+
+// Child 创建子span, 用于记录下游调用
+func (s *Span) Child(name string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	return &Span{
+		TraceID:    s.TraceID,
+		SpanID:     randomHex(8),
+		ParentID:   s.SpanID,
+		Name:       name,
+		Start:      time.Now(),
+		Attrs:      make(map[string]string),
+		TraceState: s.TraceState,
+		Sampled:    s.Sampled,
+		exporter:   s.exporter,
+	}
+}
+
+//
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	s.Attrs[key] = value
+	s.mu.Unlock()
+}
+
+// Finish 结束并导出, 重复调用无效
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if !s.End.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.End = time.Now()
+	s.mu.Unlock()
+
+	if s.Sampled && s.exporter != nil {
+		s.exporter.Export(s)
+	}
+}
+
+// TraceParent W3C traceparent头的值
+func (s *Span) TraceParent() string {
+	if s == nil {
+		return ""
+	}
+
+	flags := "00"
+	if s.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + s.TraceID + "-" + s.SpanID + "-" + flags
+}
+
+// Inject 将trace上下文写入下游请求的header
+func (s *Span) Inject(h http.Header) {
+	if s == nil {
+		return
+	}
+
+	h.Set("traceparent", s.TraceParent())
+	if s.TraceState != "" {
+		h.Set("tracestate", s.TraceState)
+	}
+}
+
+// withSpan 将span放入请求的context, 并在响应头中返回traceparent
+func withSpan(w http.ResponseWriter, r *http.Request, s *Span) *http.Request {
+	s.Inject(w.Header())
+	return r.WithContext(oscontext.WithValue(r.Context(), spanKey{}, s))
+}
+
+func spanFrom(r *http.Request) *Span {
+	s, _ := r.Context().Value(spanKey{}).(*Span)
+	return s
+}
+
+// parseTraceParent 解析version 00格式: 00-<32 hex>-<16 hex>-<2 hex>
+func parseTraceParent(v string) (traceID, parentID string, flags byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return
+	}
+
+	if parts[0] == "00" && len(parts) != 4 {
+		return
+	}
+
+	traceID, parentID = parts[1], parts[2]
+	if !isHex(parts[0], 2) || !isHex(traceID, 32) || !isHex(parentID, 16) || !isHex(parts[3], 2) {
+		return
+	}
+
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return
+	}
+
+	bts, _ := hex.DecodeString(parts[3])
+	return traceID, parentID, bts[0], true
+}
+
+func isHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+
+	return true
+}
+
+func randomHex(n int) string {
+	bts := make([]byte, n)
+	rand.Read(bts)
+	return hex.EncodeToString(bts)
+}
+
+// WriterExporter 每个span输出一行json, 用于本地调试
+type WriterExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+//
+func NewWriterExporter(w io.Writer) *WriterExporter {
+	return &WriterExporter{w: w}
+}
+
+// NewStdoutExporter 输出到标准输出
+func NewStdoutExporter() *WriterExporter {
+	return NewWriterExporter(os.Stdout)
+}
+
+// NewFileExporter 追加写入文件
+func NewFileExporter(file string) (*WriterExporter, error) {
+	f, e := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if e != nil {
+		return nil, e
+	}
+
+	return NewWriterExporter(f), nil
+}
+
+func (we *WriterExporter) Export(s *Span) {
+	s.mu.Lock()
+	bts, e := json.Marshal(s)
+	s.mu.Unlock()
+	if e != nil {
+		return
+	}
+
+	we.mu.Lock()
+	we.w.Write(append(bts, '\n'))
+	we.mu.Unlock()
+}
@@ -0,0 +1,120 @@
+package mengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const (
+	testTraceID  = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentID = "00f067aa0ba902b7"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	cases := []struct {
+		header string
+		ok     bool
+		flags  byte
+	}{
+		{"00-" + testTraceID + "-" + testParentID + "-01", true, 0x01},
+		{" 00-" + testTraceID + "-" + testParentID + "-00 ", true, 0x00},
+		{"00-" + testTraceID + "-" + testParentID + "-01-extra", false, 0}, // version 00不允许多余字段
+		{"00-" + strings.ToUpper(testTraceID) + "-" + testParentID + "-01", false, 0},
+		{"00-" + testTraceID[1:] + "-" + testParentID + "-01", false, 0},
+		{"00-" + testTraceID + "-" + testParentID + "-1", false, 0},
+		{"00-" + testTraceID + "-" + testParentID + "-0g", false, 0},
+		{"00-" + testTraceID + "-" + testParentID, false, 0},
+		{"00-00000000000000000000000000000000-" + testParentID + "-01", false, 0}, // 全零trace-id
+		{"00-" + testTraceID + "-0000000000000000-01", false, 0},                 // 全零parent-id
+		{"ff-" + testTraceID + "-" + testParentID + "-01", false, 0},             // 非法version
+		{"0-" + testTraceID + "-" + testParentID + "-01", false, 0},
+		{"zz-" + testTraceID + "-" + testParentID + "-01", false, 0},
+		{"01-" + testTraceID + "-" + testParentID + "-03", true, 0x03},          // 未来版本按00解析前4段
+		{"cc-" + testTraceID + "-" + testParentID + "-01-what-the", true, 0x01}, // 未来版本允许多余字段
+		{"cc-" + testTraceID + "-" + testParentID + "-01.x", false, 0},
+		{"", false, 0},
+		{"garbage", false, 0},
+	}
+
+	for _, c := range cases {
+		traceID, parentID, flags, ok := parseTraceParent(c.header)
+		if ok != c.ok {
+			t.Errorf("parseTraceParent(%q) ok = %v, want %v", c.header, ok, c.ok)
+			continue
+		}
+		if ok && (traceID != testTraceID || parentID != testParentID || flags != c.flags) {
+			t.Errorf("parseTraceParent(%q) = %v %v %x", c.header, traceID, parentID, flags)
+		}
+	}
+}
+
+type recordExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (re *recordExporter) Export(s *Span) {
+	re.mu.Lock()
+	re.spans = append(re.spans, s)
+	re.mu.Unlock()
+}
+
+// 合法的traceparent延续上游trace, 非法时开启新trace, 未采样时不导出
+func TestTracePropagation(t *testing.T) {
+	mux := NewMux()
+	mux.Handle("/t/trace", func(c *Context, res map[string]interface{}) Error {
+		child := c.Span().Child("db")
+		child.Finish()
+		return nil
+	}, nil)
+
+	exporter := &recordExporter{}
+	eg := newTestEngine(mux)
+	eg.TraceExporter = exporter
+
+	request := func(traceparent string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/t/trace", strings.NewReader("{}"))
+		if traceparent != "" {
+			r.Header.Set("traceparent", traceparent)
+			r.Header.Set("tracestate", "vendor=1")
+		}
+		eg.ServeHTTP(w, r)
+		return w.Header().Get("traceparent")
+	}
+
+	got := request("00-" + testTraceID + "-" + testParentID + "-01")
+	if !strings.HasPrefix(got, "00-"+testTraceID+"-") || !strings.HasSuffix(got, "-01") || strings.Contains(got, testParentID) {
+		t.Fatalf("continued traceparent = %v", got)
+	}
+	if len(exporter.spans) != 2 {
+		t.Fatalf("exported %v spans, want request and child", len(exporter.spans))
+	}
+	child, root := exporter.spans[0], exporter.spans[1]
+	if root.ParentID != testParentID || root.TraceState != "vendor=1" || child.ParentID != root.SpanID || child.TraceID != testTraceID {
+		t.Fatalf("root = %+v, child = %+v", root, child)
+	}
+
+	for _, invalid := range []string{
+		"00-00000000000000000000000000000000-" + testParentID + "-01",
+		"ff-" + testTraceID + "-" + testParentID + "-01",
+		"garbage",
+	} {
+		exporter.spans = nil
+		got = request(invalid)
+		if _, _, _, ok := parseTraceParent(got); !ok || strings.Contains(got, testTraceID) {
+			t.Errorf("traceparent %q = %v, want new trace", invalid, got)
+		}
+		if len(exporter.spans) != 2 || exporter.spans[1].ParentID != "" || exporter.spans[1].TraceState != "" {
+			t.Errorf("traceparent %q exported %+v, want new sampled root", invalid, exporter.spans)
+		}
+	}
+
+	exporter.spans = nil
+	if got = request("00-" + testTraceID + "-" + testParentID + "-00"); !strings.HasSuffix(got, "-00") || len(exporter.spans) != 0 {
+		t.Fatalf("unsampled = %v, exported %v spans", got, len(exporter.spans))
+	}
+}
@@ -0,0 +1,173 @@
+package mengine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WhiteList IP白名单, 支持IPv4/IPv6的CIDR和单个地址, 可在运行时重新加载
+//
+//	wl, _ := mengine.NewWhiteList("127.0.0.1", "10.0.0.0/8", "::1")
+//	opt.CheckWhiteList = wl.Check
+type WhiteList struct {
+	mu   sync.RWMutex
+	nets []*net.IPNet
+}
+
+//
+func NewWhiteList(entries ...string) (*WhiteList, error) {
+	wl := &WhiteList{}
+	if e := wl.Reset(entries); e != nil {
+		return nil, e
+	}
+
+	return wl, nil
+}
+
+// Reset 替换全部条目, 任一条目非法时保持原名单不变
+func (wl *WhiteList) Reset(entries []string) error {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		n, e := parseCIDR(entry)
+		if e != nil {
+			return e
+		}
+		nets = append(nets, n)
+	}
+
+	wl.mu.Lock()
+	wl.nets = nets
+	wl.mu.Unlock()
+	return nil
+}
+
+// Reload 通过回调重新加载名单
+func (wl *WhiteList) Reload(load func() ([]string, error)) error {
+	entries, e := load()
+	if e != nil {
+		return e
+	}
+
+	return wl.Reset(entries)
+}
+
+// LoadFile 从文件加载名单, 每行一个条目, '#'之后为注释
+func (wl *WhiteList) LoadFile(file string) error {
+	return wl.Reload(WhiteListFile(file))
+}
+
+// AutoReload 按interval周期性重新加载, 失败时保留旧名单并回调onErr; 返回停止函数
+func (wl *WhiteList) AutoReload(interval time.Duration, load func() ([]string, error), onErr func(e error)) (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if e := wl.Reload(load); e != nil && onErr != nil {
+					onErr(e)
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
+
+// Contains ip是否在名单内
+func (wl *WhiteList) Contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	wl.mu.RLock()
+	defer wl.mu.RUnlock()
+
+	for _, n := range wl.nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check 可直接作为EngionOption.CheckWhiteList
+func (wl *WhiteList) Check(ctx *Context) error {
+	ip := ctx.ClientIP()
+	if ip == nil {
+		return errors.New("unknown client ip")
+	}
+
+	if !wl.Contains(ip) {
+		return fmt.Errorf("ip %v not in white list", ip)
+	}
+
+	return nil
+}
+
+// WhiteListFile 返回从文件读取名单的加载函数, 用于Reload/AutoReload
+func WhiteListFile(file string) func() ([]string, error) {
+	return func() ([]string, error) {
+		bts, e := ioutil.ReadFile(file)
+		if e != nil {
+			return nil, e
+		}
+
+		var entries []string
+		scanner := bufio.NewScanner(bytes.NewReader(bts))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if i := strings.IndexByte(line, '#'); i >= 0 {
+				line = line[:i]
+			}
+
+			if line = strings.TrimSpace(line); line != "" {
+				entries = append(entries, line)
+			}
+		}
+
+		return entries, scanner.Err()
+	}
+}
+
+// parseCIDR 解析CIDR或单个地址, 单个地址按/32或/128处理
+func parseCIDR(entry string) (*net.IPNet, error) {
+	if strings.IndexByte(entry, '/') >= 0 {
+		_, n, e := net.ParseCIDR(entry)
+		if e != nil {
+			return nil, fmt.Errorf("invalid cidr %v", entry)
+		}
+		return n, nil
+	}
+
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid ip %v", entry)
+	}
+
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
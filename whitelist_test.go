@@ -0,0 +1,132 @@
+package mengine
+
+import (
+	"errors"
+	"github.com/wxiaowar/mlog"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWhiteListContains(t *testing.T) {
+	wl, e := NewWhiteList("127.0.0.1", " 10.0.0.0/8 ", "", "::1", "2001:db8::/32", "192.168.1.7/24")
+	if e != nil {
+		t.Fatal(e)
+	}
+
+	cases := []struct {
+		ip   string
+		want bool
+	}{
+		{"127.0.0.1", true},
+		{"127.0.0.2", false},
+		{"10.255.1.2", true},
+		{"11.0.0.1", false},
+		{"192.168.1.200", true}, // 主机位被掩掉
+		{"192.168.2.1", false},
+		{"::ffff:10.1.1.1", true}, // IPv4映射地址
+		{"::1", true},
+		{"::2", false},
+		{"2001:db8:ffff::1", true},
+		{"2001:db9::1", false},
+	}
+	for _, c := range cases {
+		if got := wl.Contains(net.ParseIP(c.ip)); got != c.want {
+			t.Errorf("Contains(%v) = %v, want %v", c.ip, got, c.want)
+		}
+	}
+
+	if wl.Contains(nil) {
+		t.Error("Contains(nil) should be false")
+	}
+
+	for _, bad := range []string{"10.0.0.0/33", "1.2.3", "host.local", "::1/129"} {
+		if _, e := NewWhiteList(bad); e == nil {
+			t.Errorf("NewWhiteList(%q) should fail", bad)
+		}
+	}
+}
+
+func TestWhiteListCheck(t *testing.T) {
+	wl, _ := NewWhiteList("10.0.0.0/8", "2001:db8::/32")
+	eg := NewEngine(&EngionOption{}, &mlog.MLog{}, NewMux())
+
+	cases := []struct {
+		remote string
+		ok     bool
+	}{
+		{"10.1.2.3:80", true},
+		{"[2001:db8::5]:443", true},
+		{"1.1.1.1:80", false},
+		{"garbage", false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/t/x", nil)
+		r.RemoteAddr = c.remote
+		if e := wl.Check(&Context{Request: r, eg: eg}); (e == nil) != c.ok {
+			t.Errorf("Check(%v) = %v, want ok %v", c.remote, e, c.ok)
+		}
+	}
+}
+
+func TestWhiteListReload(t *testing.T) {
+	wl, _ := NewWhiteList("10.0.0.1")
+
+	if e := wl.Reload(func() ([]string, error) { return nil, errors.New("down") }); e == nil || !wl.Contains(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("failed load = %v, want old list kept", e)
+	}
+	if e := wl.Reload(func() ([]string, error) { return []string{"10.0.0.2", "bad"}, nil }); e == nil || !wl.Contains(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("invalid entry = %v, want old list kept", e)
+	}
+	if e := wl.Reload(func() ([]string, error) { return []string{"10.0.0.2"}, nil }); e != nil ||
+		wl.Contains(net.ParseIP("10.0.0.1")) || !wl.Contains(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("reload = %v, want list replaced", e)
+	}
+
+	file := filepath.Join(t.TempDir(), "white.list")
+	ioutil.WriteFile(file, []byte("# office\n10.0.0.0/8 # vpn\n\n  ::1  \n"), 0600)
+	if e := wl.LoadFile(file); e != nil || !wl.Contains(net.ParseIP("10.9.9.9")) || !wl.Contains(net.ParseIP("::1")) {
+		t.Fatalf("LoadFile = %v", e)
+	}
+	if e := wl.LoadFile(file + ".missing"); e == nil || !wl.Contains(net.ParseIP("10.9.9.9")) {
+		t.Fatalf("missing file = %v, want old list kept", e)
+	}
+}
+
+func TestWhiteListAutoReload(t *testing.T) {
+	wl, _ := NewWhiteList()
+
+	var calls int32
+	errs := make(chan error, 16)
+	stop := wl.AutoReload(5*time.Millisecond, func() ([]string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return nil, errors.New("first load fails")
+		}
+		return []string{"10.0.0.0/8"}, nil
+	}, func(e error) { errs <- e })
+
+	deadline := time.Now().Add(time.Second)
+	for !wl.Contains(net.ParseIP("10.1.1.1")) {
+		if time.Now().After(deadline) {
+			t.Fatal("list not reloaded")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(errs) != 1 {
+		t.Fatalf("onErr called %v times, want 1", len(errs))
+	}
+
+	stop()
+	stop() // 重复调用安全
+	time.Sleep(10 * time.Millisecond)
+	n := atomic.LoadInt32(&calls)
+	time.Sleep(30 * time.Millisecond)
+	if atomic.LoadInt32(&calls) != n {
+		t.Fatal("reload continued after stop")
+	}
+}
@@ -0,0 +1,674 @@
+package mengine
+
+import (
+	"bufio"
+	oscontext "context"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/wxiaowar/mengine/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// 消息类型
+const (
+	WSText   = 1
+	WSBinary = 2
+)
+
+const (
+	wsContinuation = 0
+	wsClose        = 8
+	wsPing         = 9
+	wsPong         = 10
+)
+
+// 关闭码, 见RFC 6455 7.4.1
+const (
+	WSCloseNormal         = 1000
+	WSCloseGoingAway      = 1001
+	WSCloseProtocolError  = 1002
+	WSCloseUnsupported    = 1003
+	WSCloseNoStatus       = 1005
+	WSCloseInvalidPayload = 1007
+	WSClosePolicy         = 1008
+	WSCloseTooBig         = 1009
+	WSCloseInternal       = 1011
+)
+
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WSFunc WebSocket处理函数, 返回后连接关闭; 返回的错误以code/msg消息发送后正常关闭
+type WSFunc func(ctx *Context, conn *WSConn) Error
+
+// WSMsgFunc 处理一条json消息, 与HFunc相同: 填充res, 返回的Error写入code/msg
+type WSMsgFunc func(conn *WSConn, msg map[string]interface{}, res map[string]interface{}) Error
+
+type WSOption struct {
+	CheckOrigin  func(r *http.Request) bool // 默认允许没有Origin或Origin与Host相同的请求
+	Subprotocols []string                   // 服务端支持的子协议, 按客户端的顺序选择第一个支持的
+	ReadLimit    int64                      // 单条消息的最大字节数, 默认1M
+	PingInterval time.Duration              // 发送ping的间隔, 默认30秒; 超过2倍间隔没有收到数据时断开
+	WriteTimeout time.Duration              // 写超时, 默认10秒
+	SendQueue    int                        // 每个连接广播消息的发送队列长度, 默认64; 队列满的慢连接被断开
+}
+
+// WSCloseError 连接已关闭, Code为对端或本端发送的关闭码
+type WSCloseError struct {
+	Code int
+	Text string
+}
+
+func (ce *WSCloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %v %v", ce.Code, ce.Text)
+}
+
+// WebSocket 将WSFunc适配为HFunc注册到路由, 中间件与t/i通道的白名单、完整性校验通过后才升级, 失败时按普通接口返回;
+// x通道无法逐条加密, 不支持. 用conn.Context()感知连接关闭; 引擎开始关闭时连接以1001关闭, 关闭流程等待h返回.
+// 设置了Timeout的路由需用Mux.HandleWebSocket注册, 否则无法升级
+func WebSocket(h WSFunc, opt *WSOption) HFunc {
+	if opt == nil {
+		opt = &WSOption{}
+	}
+	if opt.ReadLimit <= 0 {
+		opt.ReadLimit = 1 << 20
+	}
+	if opt.PingInterval <= 0 {
+		opt.PingInterval = 30 * time.Second
+	}
+	if opt.WriteTimeout <= 0 {
+		opt.WriteTimeout = 10 * time.Second
+	}
+	if opt.SendQueue <= 0 {
+		opt.SendQueue = 64
+	}
+	if opt.CheckOrigin == nil {
+		opt.CheckOrigin = sameOrigin
+	}
+
+	return func(ctx *Context, res map[string]interface{}) Error {
+		if strings.HasPrefix(ctx.Path(), "/x/") {
+			return NewFailure(CodeInternal, "internal", "websocket not supported on encrypted route")
+		}
+
+		conn, e := upgrade(ctx, opt)
+		if e != nil {
+			return NewFailure(CodeInternal, "internal", fmt.Sprintf("websocket upgrade error: %v", e))
+		}
+		if !ctx.eg.trackWS(conn) {
+			conn.Close(WSCloseGoingAway, "server shutdown")
+			return nil
+		}
+		defer ctx.eg.untrackWS(conn)
+		defer conn.Close(WSCloseNormal, "")
+
+		se := h(ctx, conn)
+		if se != nil {
+			conn.Reply(nil, se)
+		}
+
+		return se
+	}
+}
+
+// HandleWebSocket 注册WebSocket路由, cfg的Timeout对其不生效, cfg可为nil
+func (m *Mux) HandleWebSocket(path string, h WSFunc, opt *WSOption, cfg *RouteConfig) {
+	m.Handle(path, WebSocket(h, opt), cfg.persist())
+}
+
+// sameOrigin 浏览器总会带Origin, 没有Origin的是非浏览器客户端
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, e := url.Parse(origin)
+	if e != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// wsHandshake 是否为WebSocket握手请求
+func wsHandshake(r *http.Request) bool {
+	return headerToken(r.Header, "Connection", "upgrade") && headerToken(r.Header, "Upgrade", "websocket")
+}
+
+// headerToken 逗号分隔的头中是否包含token, 不区分大小写
+func headerToken(h http.Header, name, token string) bool {
+	for _, v := range h[name] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func upgrade(ctx *Context, opt *WSOption) (*WSConn, error) {
+	r := ctx.Request
+	if r.Method != http.MethodGet {
+		return nil, errors.New("method must be GET")
+	}
+	if !wsHandshake(r) {
+		return nil, errors.New("not a websocket handshake")
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		return nil, errors.New("unsupported websocket version")
+	}
+
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if k, e := base64.StdEncoding.DecodeString(key); e != nil || len(k) != 16 {
+		return nil, errors.New("invalid Sec-WebSocket-Key")
+	}
+
+	if !opt.CheckOrigin(r) {
+		return nil, fmt.Errorf("origin %v not allowed", r.Header.Get("Origin"))
+	}
+
+	var protocol string
+	for _, offered := range strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ",") {
+		offered = strings.TrimSpace(offered)
+		for _, p := range opt.Subprotocols {
+			if protocol == "" && offered == p {
+				protocol = p
+			}
+		}
+	}
+
+	hj, ok := ctx.writer.(http.Hijacker)
+	if !ok {
+		return nil, errors.New("response writer can not hijack")
+	}
+
+	netConn, brw, e := hj.Hijack()
+	if e != nil {
+		return nil, e
+	}
+	atomic.StoreInt32(&ctx.streamed, 1)
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + base64.StdEncoding.EncodeToString(sum[:]) + "\r\n"
+	if protocol != "" {
+		resp += "Sec-WebSocket-Protocol: " + protocol + "\r\n"
+	}
+	resp += "\r\n"
+
+	netConn.SetDeadline(time.Time{}) // 清除Server设置的超时, 之后由连接自己管理
+	netConn.SetWriteDeadline(time.Now().Add(opt.WriteTimeout))
+	if _, e = brw.WriteString(resp); e == nil {
+		e = brw.Flush()
+	}
+	if e != nil {
+		netConn.Close()
+		return nil, e
+	}
+
+	c, cancel := oscontext.WithCancel(oscontext.Background())
+	conn := &WSConn{
+		Ctx:      ctx.Copy(),
+		Protocol: protocol,
+		conn:     netConn,
+		br:       brw.Reader,
+		bw:       brw.Writer,
+		opt:      opt,
+		c:        c,
+		cancel:   cancel,
+		send:     make(chan []byte, opt.SendQueue),
+		served:   make(chan struct{}),
+	}
+	if ctx.eg != nil {
+		conn.drain = ctx.eg.drain
+	}
+
+	go conn.run()
+	return conn, nil
+}
+
+// WSConn WebSocket连接. 读取只能在一个goroutine中进行, 写入可以并发
+type WSConn struct {
+	Ctx      *Context // 请求的副本, 连接期间可保存在Hub等处使用, Set/Get为连接级的数据
+	Protocol string   // 协商的子协议
+
+	conn net.Conn
+	br   *bufio.Reader
+	bw   *bufio.Writer
+	opt  *WSOption
+
+	wmu    sync.Mutex
+	closed bool
+	once   sync.Once
+	c      oscontext.Context
+	cancel oscontext.CancelFunc
+
+	hmu  sync.Mutex
+	hubs []*WSHub
+
+	send   chan []byte   // 广播的发送队列
+	drain  chan struct{} // 引擎开始关闭
+	served chan struct{} // 处理函数已返回
+}
+
+// Context 连接关闭时Done
+func (wc *WSConn) Context() oscontext.Context {
+	return wc.c
+}
+
+// ReadMessage 读取一条完整的消息, 自动处理分片和ping/pong/close; 连接关闭时返回*WSCloseError或网络错误
+func (wc *WSConn) ReadMessage() (int, []byte, error) {
+	var (
+		msgType int
+		msg     []byte
+	)
+
+	for {
+		wc.conn.SetReadDeadline(time.Now().Add(2 * wc.opt.PingInterval))
+
+		fin, op, payload, e := wc.readFrame()
+		if e != nil {
+			wc.shutdown()
+			return 0, nil, e
+		}
+
+		switch op {
+		case wsPing:
+			wc.writeFrame(wsPong, payload)
+			continue
+
+		case wsPong:
+			continue
+
+		case wsClose:
+			ce := &WSCloseError{Code: WSCloseNoStatus}
+			switch {
+			case len(payload) == 1:
+				return 0, nil, wc.fail(WSCloseProtocolError, "invalid close frame")
+			case len(payload) >= 2:
+				ce.Code = int(payload[0])<<8 | int(payload[1])
+				ce.Text = string(payload[2:])
+			}
+
+			echo := payload
+			if len(echo) > 2 {
+				echo = echo[:2]
+			}
+			wc.writeFrame(wsClose, echo)
+			wc.shutdown()
+			return 0, nil, ce
+
+		case WSText, WSBinary:
+			if msgType != 0 {
+				return 0, nil, wc.fail(WSCloseProtocolError, "expect continuation frame")
+			}
+			msgType, msg = int(op), payload
+
+		case wsContinuation:
+			if msgType == 0 {
+				return 0, nil, wc.fail(WSCloseProtocolError, "unexpected continuation frame")
+			}
+			if int64(len(msg)+len(payload)) > wc.opt.ReadLimit {
+				return 0, nil, wc.fail(WSCloseTooBig, "message too big")
+			}
+			msg = append(msg, payload...)
+
+		default:
+			return 0, nil, wc.fail(WSCloseProtocolError, fmt.Sprintf("unknown opcode %v", op))
+		}
+
+		if fin {
+			if msgType == WSText && !utf8.Valid(msg) {
+				return 0, nil, wc.fail(WSCloseInvalidPayload, "invalid utf8")
+			}
+			return msgType, msg, nil
+		}
+	}
+}
+
+// readFrame 客户端的帧必须有掩码, 控制帧不能分片且不超过125字节
+func (wc *WSConn) readFrame() (fin bool, op byte, payload []byte, e error) {
+	var head [8]byte
+	if _, e = io.ReadFull(wc.br, head[:2]); e != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	op = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, wc.fail(WSCloseProtocolError, "reserved bits set")
+	}
+	if head[1]&0x80 == 0 {
+		return false, 0, nil, wc.fail(WSCloseProtocolError, "client frame not masked")
+	}
+
+	size := uint64(head[1] & 0x7f)
+	switch size {
+	case 126:
+		if _, e = io.ReadFull(wc.br, head[:2]); e != nil {
+			return
+		}
+		size = uint64(head[0])<<8 | uint64(head[1])
+	case 127:
+		if _, e = io.ReadFull(wc.br, head[:8]); e != nil {
+			return
+		}
+		size = 0
+		for _, b := range head {
+			size = size<<8 | uint64(b)
+		}
+	}
+
+	if op >= wsClose && (size > 125 || !fin) {
+		return false, 0, nil, wc.fail(WSCloseProtocolError, "invalid control frame")
+	}
+	if size > uint64(wc.opt.ReadLimit) {
+		return false, 0, nil, wc.fail(WSCloseTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if _, e = io.ReadFull(wc.br, mask[:]); e != nil {
+		return
+	}
+
+	payload = make([]byte, size)
+	if _, e = io.ReadFull(wc.br, payload); e != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, op, payload, nil
+}
+
+// WriteMessage 发送一条消息, msgType为WSText或WSBinary
+func (wc *WSConn) WriteMessage(msgType int, data []byte) error {
+	return wc.writeFrame(byte(msgType), data)
+}
+
+// writeFrame 服务端的帧不加掩码
+func (wc *WSConn) writeFrame(op byte, payload []byte) error {
+	wc.wmu.Lock()
+	defer wc.wmu.Unlock()
+
+	if wc.closed {
+		return &WSCloseError{Code: WSCloseNormal, Text: "connection closed"}
+	}
+
+	head := make([]byte, 0, 10)
+	head = append(head, 0x80|op)
+	switch n := len(payload); {
+	case n <= 125:
+		head = append(head, byte(n))
+	case n <= 0xffff:
+		head = append(head, 126, byte(n>>8), byte(n))
+	default:
+		head = append(head, 127)
+		head = appendUint(head, uint64(n), 8)
+	}
+
+	wc.conn.SetWriteDeadline(time.Now().Add(wc.opt.WriteTimeout))
+	wc.bw.Write(head)
+	wc.bw.Write(payload)
+	if e := wc.bw.Flush(); e != nil {
+		wc.closed = true
+		go wc.shutdown()
+		return e
+	}
+
+	if op == wsClose {
+		wc.closed = true
+	}
+
+	return nil
+}
+
+// Receive 读取一条json消息, 数字为json.Number
+func (wc *WSConn) Receive() (map[string]interface{}, error) {
+	for {
+		_, data, e := wc.ReadMessage()
+		if e != nil {
+			return nil, e
+		}
+
+		msg := make(map[string]interface{})
+		if e = defCodec.Unmarshal(data, msg); e != nil {
+			if we := wc.Reply(nil, NewFailure(CodeInternal, "internal", fmt.Sprintf("read umarsh error: %v", e))); we != nil {
+				return nil, we
+			}
+			continue
+		}
+
+		return msg, nil
+	}
+}
+
+// Reply 按与普通接口相同的格式发送: res中的字段加上code/msg/tm, IsDebug时有detail
+func (wc *WSConn) Reply(res map[string]interface{}, se Error) error {
+	if res == nil {
+		res = make(map[string]interface{})
+	}
+
+	var (
+		code   int32  = 0
+		msg    string = "success"
+		detail string = ""
+	)
+
+	if se != nil {
+		code = se.Code()
+		msg = se.Msg()
+		detail = se.Detail()
+	}
+
+	res["code"] = code
+	res["msg"] = msg
+	res["tm"] = time.Now().Unix()
+
+	if wc.Ctx.eg != nil && wc.Ctx.eg.IsDebug {
+		res["detail"] = detail
+	}
+
+	bts, e := json.Marshal(res)
+	if e != nil {
+		return e
+	}
+
+	return wc.WriteMessage(WSText, bts)
+}
+
+// Serve 循环读取json消息交给h处理并回复, 请求中的seq原样带回便于客户端对应; 对端正常关闭时返回nil
+func (wc *WSConn) Serve(h WSMsgFunc) error {
+	for {
+		msg, e := wc.Receive()
+		if ce, ok := e.(*WSCloseError); ok && (ce.Code == WSCloseNormal || ce.Code == WSCloseGoingAway || ce.Code == WSCloseNoStatus) {
+			return nil
+		}
+		if e != nil {
+			return e
+		}
+
+		res := make(map[string]interface{})
+		se := h(wc, msg, res)
+		if seq, ok := msg["seq"]; ok {
+			res["seq"] = seq
+		}
+
+		if e = wc.Reply(res, se); e != nil {
+			return e
+		}
+	}
+}
+
+// Close 发送关闭帧并断开连接, 可重复调用
+func (wc *WSConn) Close(code int, reason string) error {
+	if len(reason) > 123 { // 控制帧不超过125字节
+		reason = reason[:123]
+	}
+
+	e := wc.writeFrame(wsClose, append([]byte{byte(code >> 8), byte(code)}, reason...))
+	wc.shutdown()
+	return e
+}
+
+// fail 协议错误时关闭连接
+func (wc *WSConn) fail(code int, reason string) error {
+	wc.Close(code, reason)
+	return &WSCloseError{Code: code, Text: reason}
+}
+
+// shutdown 断开底层连接并退出所有Hub
+func (wc *WSConn) shutdown() {
+	wc.once.Do(func() {
+		wc.cancel()
+		wc.conn.Close() // 先断开, 阻塞中的写立即返回
+
+		wc.wmu.Lock()
+		wc.closed = true
+		wc.wmu.Unlock()
+
+		wc.hmu.Lock()
+		hubs := wc.hubs
+		wc.hubs = nil
+		wc.hmu.Unlock()
+
+		for _, hub := range hubs {
+			hub.Leave(wc)
+		}
+	})
+}
+
+// run 定时发送ping(对端的pong在ReadMessage中延长读超时), 发送广播队列中的消息, 引擎开始关闭时以1001关闭
+func (wc *WSConn) run() {
+	ticker := time.NewTicker(wc.opt.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wc.c.Done():
+			return
+		case <-wc.drain:
+			wc.Close(WSCloseGoingAway, "server shutdown")
+			return
+		case bts := <-wc.send:
+			if wc.WriteMessage(WSText, bts) != nil {
+				wc.shutdown()
+				return
+			}
+		case <-ticker.C:
+			if wc.writeFrame(wsPing, nil) != nil {
+				wc.shutdown()
+				return
+			}
+		}
+	}
+}
+
+// enqueue 放入发送队列, 队列满时断开连接, 不让慢连接拖住广播方
+func (wc *WSConn) enqueue(bts []byte) bool {
+	if wc.c.Err() != nil {
+		return false
+	}
+
+	select {
+	case wc.send <- bts:
+		return true
+	default:
+		wc.shutdown()
+		return false
+	}
+}
+
+// WSHub 一组连接, 用于广播; 连接关闭时自动退出
+type WSHub struct {
+	mu    sync.RWMutex
+	conns map[*WSConn]struct{}
+}
+
+//
+func NewWSHub() *WSHub {
+	return &WSHub{conns: make(map[*WSConn]struct{})}
+}
+
+// Join 加入Hub, 已关闭的连接不会加入
+func (hub *WSHub) Join(wc *WSConn) {
+	wc.hmu.Lock()
+	defer wc.hmu.Unlock()
+
+	if wc.c.Err() != nil {
+		return
+	}
+	wc.hubs = append(wc.hubs, hub)
+
+	hub.mu.Lock()
+	hub.conns[wc] = struct{}{}
+	hub.mu.Unlock()
+}
+
+func (hub *WSHub) Leave(wc *WSConn) {
+	hub.mu.Lock()
+	delete(hub.conns, wc)
+	hub.mu.Unlock()
+}
+
+func (hub *WSHub) Len() int {
+	hub.mu.RLock()
+	defer hub.mu.RUnlock()
+
+	return len(hub.conns)
+}
+
+// Broadcast 向所有连接发送成功的消息, 返回放入发送队列的连接数
+func (hub *WSHub) Broadcast(res map[string]interface{}) int {
+	return hub.BroadcastFilter(res, nil)
+}
+
+// BroadcastFilter 向filter返回true的连接发送, filter为nil时发送给所有连接;
+// 消息只编码一次, 放入每个连接的发送队列后即返回; 队列已满或写失败的连接会被关闭并退出Hub
+func (hub *WSHub) BroadcastFilter(res map[string]interface{}, filter func(wc *WSConn) bool) int {
+	msg := make(map[string]interface{}, len(res)+3)
+	for k, v := range res {
+		msg[k] = v
+	}
+	msg["code"] = 0
+	msg["msg"] = "success"
+	msg["tm"] = time.Now().Unix()
+
+	bts, e := json.Marshal(msg)
+	if e != nil {
+		return 0
+	}
+
+	hub.mu.RLock()
+	conns := make([]*WSConn, 0, len(hub.conns))
+	for wc := range hub.conns {
+		if filter == nil || filter(wc) {
+			conns = append(conns, wc)
+		}
+	}
+	hub.mu.RUnlock()
+
+	sent := 0
+	for _, wc := range conns {
+		if wc.enqueue(bts) {
+			sent++
+		}
+	}
+
+	return sent
+}
@@ -0,0 +1,178 @@
+package mengine
+
+import (
+	"bufio"
+	oscontext "context"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// dialWS 完成握手, 返回连接和读取服务端帧用的reader
+func dialWS(t *testing.T, eg *Engine, path string) (net.Conn, *bufio.Reader) {
+	ln, e := net.Listen("tcp", "127.0.0.1:0")
+	if e != nil {
+		t.Fatal(e)
+	}
+	svr := &http.Server{Handler: eg}
+	t.Cleanup(func() { svr.Close() })
+	go svr.Serve(ln)
+
+	conn, e := net.Dial("tcp", ln.Addr().String())
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	conn.Write([]byte("GET " + path + " HTTP/1.1\r\n" +
+		"Host: " + ln.Addr().String() + "\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Sec-WebSocket-Version: 13\r\n" +
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, e := http.ReadResponse(br, nil)
+	if e != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake = %v, %v", resp, e)
+	}
+
+	return conn, br
+}
+
+// readWSFrame 读取服务端的一帧, 跳过ping
+func readWSFrame(t *testing.T, conn net.Conn, br *bufio.Reader) (byte, []byte) {
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var head [2]byte
+		if _, e := io.ReadFull(br, head[:]); e != nil {
+			t.Fatalf("read frame error: %v", e)
+		}
+
+		payload := make([]byte, head[1]&0x7f)
+		if _, e := io.ReadFull(br, payload); e != nil {
+			t.Fatalf("read payload error: %v", e)
+		}
+
+		if op := head[0] & 0x0f; op != wsPing {
+			return op, payload
+		}
+	}
+}
+
+// 关闭时连接收到1001, 处理函数返回后才执行回调
+func TestWSShutdown(t *testing.T) {
+	var returned int32
+	mux := NewMux()
+	mux.Handle("/t/ws", WebSocket(func(c *Context, conn *WSConn) Error {
+		conn.Ctx.SetCookie(&http.Cookie{Name: "k", Value: "v"}) // 副本的writer不会panic
+		conn.Ctx.ResponseHeader().Set("X-Test", "1")
+
+		_, _, e := conn.ReadMessage()
+		time.Sleep(50 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+		if e == nil {
+			t.Error("ReadMessage should fail after shutdown")
+		}
+		return nil
+	}, nil), nil)
+	eg := newTestEngine(mux)
+
+	var hooked int32
+	eg.OnShutdown("check", func(ctx oscontext.Context) error {
+		atomic.StoreInt32(&hooked, atomic.LoadInt32(&returned))
+		return nil
+	})
+
+	conn, br := dialWS(t, eg, "/t/ws")
+	time.Sleep(20 * time.Millisecond) // 等待处理函数登记
+
+	if drained, e := eg.shutdown(2 * time.Second); !drained || e != nil {
+		t.Fatalf("shutdown = %v, %v, want drained", drained, e)
+	}
+	if atomic.LoadInt32(&hooked) != 1 {
+		t.Error("hook ran before websocket handler returned")
+	}
+
+	op, payload := readWSFrame(t, conn, br)
+	if op != wsClose || len(payload) < 2 || int(payload[0])<<8|int(payload[1]) != WSCloseGoingAway {
+		t.Errorf("frame = %v %v, want close 1001", op, payload)
+	}
+}
+
+// 处理函数超过关闭的超时仍未返回时drained为false
+func TestWSShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+
+	mux := NewMux()
+	mux.Handle("/t/ws", WebSocket(func(c *Context, conn *WSConn) Error {
+		<-release
+		return nil
+	}, nil), nil)
+	eg := newTestEngine(mux)
+
+	dialWS(t, eg, "/t/ws")
+	time.Sleep(20 * time.Millisecond)
+
+	if drained, _ := eg.shutdown(100 * time.Millisecond); drained {
+		t.Fatal("shutdown drained = true with a running websocket handler")
+	}
+}
+
+// HandleWebSocket注册的路由不受Timeout限制, 超时后的写入仍发送到连接; 调用方的cfg不被修改
+func TestWSRouteTimeout(t *testing.T) {
+	mux := NewMux()
+	cfg := &RouteConfig{Timeout: 20 * time.Millisecond}
+	mux.HandleWebSocket("/t/ws", func(c *Context, conn *WSConn) Error {
+		time.Sleep(100 * time.Millisecond)
+		conn.WriteMessage(WSText, []byte("late"))
+		return nil
+	}, nil, cfg)
+	eg := newTestEngine(mux)
+
+	conn, br := dialWS(t, eg, "/t/ws")
+	if op, payload := readWSFrame(t, conn, br); op != WSText || string(payload) != "late" {
+		t.Errorf("frame = %v %q, want text late", op, payload)
+	}
+	if cfg.persistent {
+		t.Error("HandleWebSocket modified caller's RouteConfig")
+	}
+}
+
+// 发送队列满时断开慢连接, 广播不阻塞
+func TestWSHubQueueFull(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	c, cancel := oscontext.WithCancel(oscontext.Background())
+	wc := &WSConn{
+		conn:   server,
+		bw:     bufio.NewWriter(server),
+		opt:    &WSOption{WriteTimeout: time.Second},
+		c:      c,
+		cancel: cancel,
+		send:   make(chan []byte, 1),
+	}
+
+	hub := NewWSHub()
+	hub.Join(wc)
+
+	if n := hub.Broadcast(map[string]interface{}{"n": 1}); n != 1 {
+		t.Fatalf("first Broadcast = %v, want 1", n)
+	}
+	if n := hub.Broadcast(map[string]interface{}{"n": 2}); n != 0 {
+		t.Fatalf("second Broadcast = %v, want 0", n)
+	}
+	if wc.Context().Err() == nil || hub.Len() != 0 {
+		t.Errorf("slow connection not closed, hub len %v", hub.Len())
+	}
+
+	if msg := <-wc.send; !strings.Contains(string(msg), `"n":1`) {
+		t.Errorf("queued = %s", msg)
+	}
+}